@@ -0,0 +1,165 @@
+// Package logger writes log lines in either a human readable format or as JSON
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Fields are the optional structured fields of a log line
+type Fields struct {
+	Zone       string
+	Nameserver string
+	IP         net.IP
+	Records    int64
+}
+
+// levels of log lines
+const (
+	levelTrace = "trace"
+	levelDebug = "debug"
+	levelInfo  = "info"
+	levelWarn  = "warn"
+	levelFatal = "fatal"
+)
+
+// verbosity levels
+const (
+	// VerbosityDebug writes Debug lines such as the outcome of every transfer attempt
+	VerbosityDebug = 1
+	// VerbosityTrace also writes Trace lines such as every DNS query and answer
+	VerbosityTrace = 2
+)
+
+// Logger writes log lines to an io.Writer and is safe for concurrent use
+type Logger struct {
+	out       *log.Logger
+	json      bool
+	verbosity int
+	// map of the ASCII form of internationalized zone names to their Unicode form
+	unicode map[string]string
+}
+
+// New returns a Logger writing to w, as JSON lines if json is set
+// Debug lines are only written with a verbosity of at least VerbosityDebug and Trace lines with VerbosityTrace
+func New(w io.Writer, json bool, verbosity int) *Logger {
+	l := &Logger{
+		json:      json,
+		verbosity: verbosity,
+	}
+	if json {
+		l.out = log.New(w, "", 0)
+	} else {
+		l.out = log.New(w, "", log.LstdFlags)
+	}
+	return l
+}
+
+// SetUnicodeNames shows the Unicode form of the zones in names next to their ASCII form, names maps ASCII to Unicode
+// it must be called before the Logger is used by more than one goroutine
+func (l *Logger) SetUnicodeNames(names map[string]string) {
+	l.unicode = names
+}
+
+// Verbose returns true if Debug lines are written
+func (l *Logger) Verbose() bool {
+	return l.verbosity >= VerbosityDebug
+}
+
+// Verbosity returns the verbosity level
+func (l *Logger) Verbosity() int {
+	return l.verbosity
+}
+
+// Trace writes a line only with VerbosityTrace
+func (l *Logger) Trace(f Fields, format string, v ...interface{}) {
+	if l.verbosity >= VerbosityTrace {
+		l.write(levelTrace, f, format, v...)
+	}
+}
+
+// Debug writes a line only when verbose
+func (l *Logger) Debug(f Fields, format string, v ...interface{}) {
+	if l.Verbose() {
+		l.write(levelDebug, f, format, v...)
+	}
+}
+
+// Info writes a line
+func (l *Logger) Info(f Fields, format string, v ...interface{}) {
+	l.write(levelInfo, f, format, v...)
+}
+
+// Warn writes a line marked as a warning
+func (l *Logger) Warn(f Fields, format string, v ...interface{}) {
+	l.write(levelWarn, f, format, v...)
+}
+
+// Fatal writes a line and exits
+func (l *Logger) Fatal(f Fields, format string, v ...interface{}) {
+	l.write(levelFatal, f, format, v...)
+	os.Exit(1)
+}
+
+// jsonLine is a line written in JSON mode
+type jsonLine struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Zone  string `json:"zone,omitempty"`
+	// ZoneUnicode is the Unicode form of an internationalized Zone
+	ZoneUnicode string `json:"zone_unicode,omitempty"`
+	Nameserver  string `json:"nameserver,omitempty"`
+	IP          string `json:"ip,omitempty"`
+	Records     int64  `json:"records,omitempty"`
+	Msg         string `json:"msg"`
+}
+
+func (l *Logger) write(level string, f Fields, format string, v ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
+	if l.json {
+		line := jsonLine{
+			Time:        time.Now().UTC().Format(time.RFC3339),
+			Level:       level,
+			Zone:        f.Zone,
+			ZoneUnicode: l.unicode[f.Zone],
+			Nameserver:  f.Nameserver,
+			Records:     f.Records,
+			Msg:         msg,
+		}
+		if f.IP != nil {
+			line.IP = f.IP.String()
+		}
+		// a struct of strings always marshals
+		b, _ := json.Marshal(line)
+		l.out.Print(string(b))
+		return
+	}
+
+	var b strings.Builder
+	if unicode, ok := l.unicode[f.Zone]; ok {
+		fmt.Fprintf(&b, "[%s %s] ", f.Zone, unicode)
+	} else if len(f.Zone) > 0 {
+		fmt.Fprintf(&b, "[%s] ", f.Zone)
+	}
+	if len(f.Nameserver) > 0 {
+		fmt.Fprintf(&b, "%s ", f.Nameserver)
+	}
+	if f.IP != nil {
+		fmt.Fprintf(&b, "(%s) ", f.IP.String())
+	}
+	if level == levelWarn {
+		b.WriteString("WARNING: ")
+	}
+	b.WriteString(msg)
+	line := b.String()
+	if level == levelDebug || level == levelTrace {
+		line = strings.ReplaceAll(line, "\n", "\n\t")
+	}
+	l.out.Print(line)
+}
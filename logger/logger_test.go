@@ -0,0 +1,40 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestUnicodeNames(t *testing.T) {
+	names := map[string]string{"xn--bcher-kva.example.": "bücher.example."}
+
+	var text bytes.Buffer
+	l := New(&text, false, 0)
+	l.SetUnicodeNames(names)
+	l.Info(Fields{Zone: "xn--bcher-kva.example."}, "transfer")
+	l.Info(Fields{Zone: "example.com."}, "transfer")
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), text.String())
+	}
+	if !strings.Contains(lines[0], "[xn--bcher-kva.example. bücher.example.] transfer") {
+		t.Errorf("got %q, want the Unicode form next to the zone", lines[0])
+	}
+	if !strings.Contains(lines[1], "[example.com.] transfer") {
+		t.Errorf("got %q, want only the zone", lines[1])
+	}
+
+	var out bytes.Buffer
+	l = New(&out, true, 0)
+	l.SetUnicodeNames(names)
+	l.Info(Fields{Zone: "xn--bcher-kva.example."}, "transfer")
+	var line jsonLine
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line.Zone != "xn--bcher-kva.example." || line.ZoneUnicode != "bücher.example." {
+		t.Errorf("got zone %q and zone_unicode %q", line.Zone, line.ZoneUnicode)
+	}
+}
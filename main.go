@@ -1,151 +1,699 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"math/rand"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/lanrat/allxfr/zone"
-
+	"github.com/lanrat/allxfr/logger"
 	"github.com/lanrat/allxfr/psl"
+	"github.com/lanrat/allxfr/save"
+	"github.com/lanrat/allxfr/scan"
+	"github.com/lanrat/allxfr/zone"
 
 	"github.com/miekg/dns"
-	"golang.org/x/sync/errgroup"
+	"github.com/weppos/publicsuffix-go/publicsuffix"
 )
 
 var (
-	parallel  = flag.Uint("parallel", 10, "number of parallel zone transfers to perform")
-	saveDir   = flag.String("out", "zones", "directory to save found zones in")
-	verbose   = flag.Bool("verbose", false, "enable verbose output")
-	zonefile  = flag.String("zonefile", "", "use the provided zonefile instead of getting the root zonefile")
-	ns        = flag.String("ns", "", "nameserver to use for manually querying of records not in zone file")
-	saveAll   = flag.Bool("save-all", false, "attempt AXFR from every nameserver for a given zone and save all answers")
-	usePSL    = flag.Bool("psl", false, "attempt AXFR from zones listed in the public suffix list, requires -ns flag")
-	ixfr      = flag.Bool("ixfr", false, "attempt an IXFR instead of AXFR")
-	dryRun    = flag.Bool("dry-run", false, "only test if xfr is allowed by retrieving one envelope")
-	retry     = flag.Int("retry", 3, "number of times to retry failed operations")
-	overwrite = flag.Bool("overwrite", false, "if zone already exists on disk, overwrite it with newer data")
+	parallel      = flag.Uint("parallel", 10, "number of parallel zone transfers to perform")
+	saveDir       = flag.String("out", "zones", "directory to save found zones in, a comma separated list of directories to shard them between, or an s3://bucket/prefix URL to upload them to")
+	verbose       = verbosityFlag("verbose", "v", "enable verbose output, -verbose=2 or -vv also logs every DNS query and transfer attempt")
+	zonefile      = flag.String("zonefile", "", "use the provided zonefile instead of getting the root zonefile")
+	zoneOrigin    = flag.String("zonefile-origin", "", "origin for relative names in -zonefile, inferred from names like example.com.zone if not set")
+	ns            = flag.String("ns", "", "nameserver to use for manually querying of records not in zone file")
+	saveAll       = flag.Bool("save-all", false, "attempt AXFR from every nameserver for a given zone and save all answers")
+	usePSL        = flag.Bool("psl", false, "attempt AXFR from zones listed in the public suffix list, requires -ns flag")
+	ixfr          = flag.Bool("ixfr", false, "attempt an IXFR instead of AXFR")
+	dryRun        = flag.Bool("dry-run", false, "only test if xfr is allowed by retrieving one envelope, and report every nameserver IP that allows it")
+	retry         = flag.Int("retry", 3, "number of times to retry failed operations")
+	overwrite     = flag.Bool("overwrite", false, "if zone already exists on disk, overwrite it with newer data")
+	sortZone      = flag.Bool("sort", false, "sort records in saved zone files by name, type and data, holds each zone in memory until the transfer completes")
+	tcp           = flag.Bool("tcp", false, "use TCP instead of UDP for all DNS queries")
+	rootHints     = flag.String("root-hints", "", "use the root servers in the provided root hints file (named.root) instead of querying for them")
+	reverse       = flag.String("reverse", "", "comma separated list of CIDRs to attempt AXFR of their reverse DNS zones")
+	exclude       = flag.String("exclude", "", "file of domains, IPs and CIDRs to never attempt transfers from, one per line")
+	summaryFile   = flag.String("summary", "", "write a JSON summary of the results to this file when done")
+	ipv4Only      = flag.Bool("4", false, "only use IPv4 nameserver addresses")
+	ipv6Only      = flag.Bool("6", false, "only use IPv6 nameserver addresses")
+	globalTimeout = flag.Duration("timeout", 15*time.Second, "timeout for dialing, reading and writing each DNS query and zone transfer")
+	bwLimit       = flag.Uint("bwlimit", 0, "limit the combined download rate of all zone transfers to this many bytes per second, 0 for unlimited")
+	shuffle       = flag.Bool("shuffle", false, "transfer zones in a random order")
+	seed          = flag.Int64("seed", 0, "random seed for -shuffle, a time based seed is used and logged if not set")
+	interleave    = flag.Bool("interleave", false, "with -shuffle, reorder zones so that consecutive zones do not share a nameserver where possible")
+	zoneRate      = flag.Float64("rate", 0, "maximum number of new zones to start transferring per second, 0 for unlimited")
+	saveMeta      = flag.Bool("meta", false, "also save the metadata of each zone to a .meta.json file next to it")
+	pslCache      = flag.String("psl-cache", defaultPSLCache(), "file to cache the public suffix list in, empty to always download it")
+	pslCacheTTL   = flag.Duration("psl-cache-ttl", 24*time.Hour, "maximum age of the cached public suffix list before checking for a newer one")
+	pslFile       = flag.String("psl-file", "", "read the public suffix list for -psl from this file instead of downloading it")
+	pslPrivate    = flag.Bool("psl-private", false, "include the private domains in the public suffix list with -psl")
+	pslTLDs       = flag.String("psl-tld", "", "comma separated list of TLDs to limit -psl domains to")
+	maxRecords    = flag.Int64("max-records", 0, "abort transfers with more than this many records, 0 for unlimited, the root zone uses -root-max-records")
+	maxSize       = flag.Int64("max-size", 0, "abort transfers larger than this many bytes of uncompressed DNS wire format records, 0 for unlimited, the root zone uses -root-max-size")
+	rootMaxRecs   = flag.Int64("root-max-records", zone.DefaultRootMaxRecords, "abort the root zone transfer with more than this many records")
+	rootMaxSize   = flag.Int64("root-max-size", zone.DefaultRootMaxSize, "abort the root zone transfer larger than this many bytes of uncompressed DNS wire format records")
+	compare       = flag.Bool("compare", false, "with -save-all, compare the records returned by each nameserver of a zone and report any differences")
+	logJSON       = flag.Bool("log-json", false, "write log lines as JSON objects with level, zone, zone_unicode, nameserver, ip, records and msg fields")
+	nsVersion     = flag.Bool("ns-version", false, "query each nameserver IP for its software version with version.bind and save it with the zone")
+	deadline      = flag.Duration("deadline", 0, "stop the scan after this long, keeping the zones transferred so far, 0 for no limit")
+	allowPrivate  = flag.Bool("allow-private", false, "attempt transfers from private, loopback and reserved nameserver IPs, which are skipped by default")
+	layout        = flag.String("layout", scan.LayoutFlat, "arrangement of zone files in -out: flat, tld for a directory per TLD, or hashed for 256 directories")
+	gzipLevel     = flag.Int("gzip-level", -1, "gzip compression level of saved zones from 1 (fastest) to 9 (smallest), 0 to save uncompressed .zone files, -1 for the default")
+	diff          = flag.Bool("diff", false, "if a zone already exists on disk, save only the records added and removed since then to a .diff file next to it")
+	rootTimeout   = flag.Duration("root-timeout", time.Minute, "maximum time to spend transferring the root zone from each root server before trying the next")
+	sourceIP      = flag.String("source-ip", "", "local IP address to send all queries and transfers from, limits nameserver addresses to its address family")
+	perIP         = flag.Uint("per-ip", 0, "maximum number of transfers from a single nameserver IP at the same time, 0 for unlimited")
+	server        = flag.String("server", "", "transfer only the zones given as arguments from this nameserver hostname or IP, skipping the root zone and nameserver lookups")
+	raceNS        = flag.Bool("race-ns", false, "attempt transfers from all of a zone's nameserver IPs at the same time and keep the first to answer, can not be used with -save-all or -dry-run")
+	maxOpenFiles  = flag.Int("max-open-files", 0, "maximum number of zone files to write at the same time, 0 for half of the open file limit, -1 for unlimited")
+	cookies       = flag.Bool("cookies", false, "send DNS cookies (RFC 7873) with queries and reuse the cookie each server returns")
+	traceFlag     = flag.Bool("vv", false, "same as -verbose=2")
+	serials       = flag.Bool("serials", false, "after transferring a zone, query its other nameserver IPs for their SOA serial and report any differences in the summary")
+	saveRoot      = flag.Bool("save-root", false, "also save the root zone transferred to find the TLDs in -out")
+	zoneTimeout   = flag.Duration("zone-timeout", 0, "abandon a zone after spending this long on all of its transfer attempts, 0 for no limit")
+	rootTries     = flag.Int("root-tries", 0, "maximum number of root servers to try transferring the root zone from, 0 to try all of them")
+	rootShuffle   = flag.Bool("root-shuffle", false, "try the root servers in a random order instead of starting with a.root-servers.net")
+	keepPartial   = flag.Bool("keep-partial", false, "save the records of transfers that fail, are canceled or exceed a limit part way to a .partial.zone file instead of discarding them")
+	leaks         = flag.String("leaks-file", "", "append a line with the zone, nameserver, IP and records of each successful transfer to this file as soon as it finishes, followed by the Unicode form of internationalized zones")
+	nsUnion       = flag.Bool("ns-union", false, "with -ns, query the nameservers of each zone over both UDP and TCP and attempt every nameserver in either answer, doubles the NS queries")
+	parentNS      = flag.Bool("parent-ns", false, "with -ns, also ask the nameservers of each zone's parent for its delegation, attempt any nameservers it lists and report delegations that differ from the zone's nameservers")
+	maxNSIPs      = flag.Int("max-ns-ips", 0, "maximum number of distinct nameserver IPs to attempt for each zone, 0 for unlimited")
+	queryRetries  = flag.Int("query-retries", 1, "number of times to resend a DNS query to the same server after it times out")
+	subzones      = flag.Int("subzones", 0, "also attempt zones delegated by NS records in transferred zones, up to this many levels below the starting zones")
 )
 
 var (
 	localNameserver string
-	totalXFR        uint32
-)
-
-const (
-	globalTimeout = 15 * time.Second
+	scanner         *scan.Scanner
+	logs            *logger.Logger
+	// map of the ASCII form of internationalized names given on the command line to their Unicode form
+	unicodeNames = make(map[string]string)
 )
 
 func main() {
-	//log.SetFlags(0)
 	flag.Parse()
+	if *traceFlag {
+		*verbose = logger.VerbosityTrace
+	}
+	logs = logger.New(os.Stderr, *logJSON, int(*verbose))
+	if len(*server) == 0 && flag.Arg(0) == "validate" {
+		if flag.NArg() < 2 {
+			logs.Fatal(logger.Fields{}, "validate requires the zone files to check as arguments")
+		}
+		if !validateZoneFiles(flag.Args()[1:]) {
+			os.Exit(1)
+		}
+		return
+	}
 	if *usePSL && len(*ns) == 0 {
-		log.Fatal("must pass nameserver with -ns when using -psl")
+		logs.Fatal(logger.Fields{}, "must pass nameserver with -ns when using -psl")
+	}
+	if *nsUnion && len(*ns) == 0 {
+		logs.Fatal(logger.Fields{}, "-ns-union requires -ns")
+	}
+	if *parentNS && (len(*ns) == 0 || len(*server) > 0) {
+		logs.Fatal(logger.Fields{}, "-parent-ns requires -ns and can not be used with -server")
+	}
+	if len(*pslFile) > 0 && !*usePSL {
+		logs.Fatal(logger.Fields{}, "-psl-file requires -psl")
+	}
+	if *compare && !*saveAll {
+		logs.Fatal(logger.Fields{}, "-compare requires -save-all")
+	}
+	if *saveRoot && (len(*zonefile) > 0 || len(*server) > 0) {
+		logs.Fatal(logger.Fields{}, "-save-root can not be used with -zonefile or -server")
+	}
+	if *serials && *saveAll {
+		logs.Fatal(logger.Fields{}, "-serials can not be used with -save-all")
+	}
+	if *raceNS && (*saveAll || *dryRun) {
+		logs.Fatal(logger.Fields{}, "-race-ns can not be used with -save-all or -dry-run")
+	}
+	if *interleave && !*shuffle {
+		logs.Fatal(logger.Fields{}, "-interleave requires -shuffle")
 	}
 	if *retry < 1 {
-		log.Fatal("retry must be positive")
+		logs.Fatal(logger.Fields{}, "retry must be positive")
+	}
+	if *zoneRate < 0 {
+		logs.Fatal(logger.Fields{}, "rate must not be negative")
 	}
-	if flag.NArg() > 0 {
-		log.Fatalf("unexpected arguments %v", flag.Args())
+	if len(*server) > 0 {
+		if flag.NArg() == 0 {
+			logs.Fatal(logger.Fields{}, "-server requires the zones to transfer as arguments")
+		}
+		if len(*zonefile) > 0 || *usePSL || len(*reverse) > 0 {
+			logs.Fatal(logger.Fields{}, "-server can not be used with -zonefile, -psl or -reverse")
+		}
+	} else if flag.NArg() > 0 {
+		logs.Fatal(logger.Fields{}, "unexpected arguments %v", flag.Args())
+	}
+	if *subzones < 0 {
+		logs.Fatal(logger.Fields{}, "subzones must not be negative")
+	}
+	if *queryRetries < 0 {
+		logs.Fatal(logger.Fields{}, "query-retries must not be negative")
+	}
+	if *globalTimeout <= 0 {
+		logs.Fatal(logger.Fields{}, "timeout must be positive")
+	}
+	if *gzipLevel < -1 || *gzipLevel > 9 {
+		logs.Fatal(logger.Fields{}, "gzip-level must be between -1 and 9")
+	}
+	if *deadline < 0 {
+		logs.Fatal(logger.Fields{}, "deadline must not be negative")
+	}
+	if *zoneTimeout < 0 {
+		logs.Fatal(logger.Fields{}, "zone-timeout must not be negative")
+	}
+	if *rootTimeout <= 0 {
+		logs.Fatal(logger.Fields{}, "root-timeout must be positive")
+	}
+	if *maxNSIPs < 0 {
+		logs.Fatal(logger.Fields{}, "max-ns-ips must not be negative")
+	}
+	if *rootMaxRecs <= 0 || *rootMaxSize <= 0 {
+		logs.Fatal(logger.Fields{}, "root-max-records and root-max-size must be positive")
+	}
+	if *rootTries < 0 {
+		logs.Fatal(logger.Fields{}, "root-tries must not be negative")
+	}
+	var localIP net.IP
+	if len(*sourceIP) > 0 {
+		localIP = net.ParseIP(*sourceIP)
+		if localIP == nil {
+			logs.Fatal(logger.Fields{}, "invalid source-ip %q", *sourceIP)
+		}
 	}
 	var err error
 	localNameserver, err = getNameserver()
 	check(err)
-	v("using initial nameserver %s", localNameserver)
+	v(logger.VerbosityDebug, "using initial nameserver %s", localNameserver)
+	var excludes *scan.ExcludeList
+	if len(*exclude) > 0 {
+		excludes, err = scan.LoadExcludeList(*exclude)
+		check(err)
+		domains, nets := excludes.Len()
+		v(logger.VerbosityDebug, "loaded %d excluded domains and %d excluded networks", domains, nets)
+	}
+	var onTransfer func(scan.TransferResult)
+	if len(*leaks) > 0 {
+		leaksOut, err := openLeaksFile(*leaks)
+		check(err)
+		defer leaksOut.Close()
+		onTransfer = leaksOut.add
+	}
+	saveDirs := strings.Split(*saveDir, ",")
+	for _, dir := range saveDirs {
+		if len(dir) == 0 {
+			logs.Fatal(logger.Fields{}, "invalid -out %q, empty directory", *saveDir)
+		}
+		if len(saveDirs) > 1 && save.IsS3URL(dir) {
+			logs.Fatal(logger.Fields{}, "an S3 -out can not be sharded with other locations")
+		}
+	}
+	if len(saveDirs) == 1 {
+		// a single directory is SaveDir
+		saveDirs = nil
+	}
+	var newSink scan.SinkFactory
+	if save.IsS3URL(*saveDir) && !*dryRun {
+		if *diff {
+			logs.Fatal(logger.Fields{}, "-diff can not be used with an S3 -out")
+		}
+		// uploads of finished zones are not canceled by an interrupt
+		bucket, err := save.NewS3Bucket(context.Background(), *saveDir)
+		check(err)
+		newSink = s3Sink(bucket)
+	}
+	scanner, err = scan.New(scan.Options{
+		Parallel:         *parallel,
+		SaveDir:          *saveDir,
+		SaveDirs:         saveDirs,
+		Layout:           *layout,
+		SaveAll:          *saveAll,
+		RaceNS:           *raceNS,
+		MaxNSIPs:         *maxNSIPs,
+		SubzoneDepth:     *subzones,
+		Serials:          *serials,
+		Nameserver:       localNameserver,
+		QueryNameservers: len(*ns) > 0 && len(*server) == 0,
+		NSUnion:          *nsUnion,
+		ParentNS:         *parentNS,
+		IXFR:             *ixfr,
+		DryRun:           *dryRun,
+		Retry:            *retry,
+		QueryRetries:     *queryRetries,
+		Overwrite:        *overwrite,
+		Diff:             *diff,
+		KeepPartial:      *keepPartial,
+		Sort:             *sortZone,
+		Meta:             *saveMeta,
+		GzipLevel:        max(*gzipLevel, 0),
+		Uncompressed:     *gzipLevel == 0,
+		MaxOpenFiles:     *maxOpenFiles,
+		TCP:              *tcp,
+		Cookies:          *cookies,
+		IPv4Only:         *ipv4Only,
+		IPv6Only:         *ipv6Only,
+		SourceIP:         localIP,
+		Timeout:          *globalTimeout,
+		ZoneTimeout:      *zoneTimeout,
+		BandwidthLimit:   *bwLimit,
+		ZoneRate:         *zoneRate,
+		PerIP:            *perIP,
+		Shuffle:          *shuffle,
+		Seed:             *seed,
+		Interleave:       *interleave,
+		MaxRecords:       *maxRecords,
+		MaxSize:          *maxSize,
+		Compare:          *compare,
+		Exclude:          excludes,
+		AllowPrivate:     *allowPrivate,
+		NSVersion:        *nsVersion,
+		Logger:           logs,
+		NewSink:          newSink,
+		OnTransfer:       onTransfer,
+	})
+	check(err)
 
 	start := time.Now()
+	// cancel on the first interrupt, a second interrupt kills the process
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCtx.Done()
+		stop()
+	}()
+	ctx := sigCtx
+	if *deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, start.Add(*deadline))
+		defer cancel()
+	}
+
 	var z zone.Zone
-	if len(*zonefile) == 0 {
-		rootNameservers, err := zone.GetRootServers(localNameserver)
+	if len(*server) > 0 {
+		z, err = serverZone(*server, flag.Args())
+		check(err)
+	} else if len(*zonefile) == 0 {
+		var rootNameservers []string
+		if len(*rootHints) > 0 {
+			rootNameservers, err = zone.ParseRootHints(*rootHints)
+		} else {
+			rootNameservers, err = zone.GetRootServers(scanner.Client(), localNameserver)
+		}
 		check(err)
+		if *rootShuffle {
+			rand.Shuffle(len(rootNameservers), func(i, j int) {
+				rootNameservers[i], rootNameservers[j] = rootNameservers[j], rootNameservers[i]
+			})
+		}
+		if *rootTries > 0 && *rootTries < len(rootNameservers) {
+			rootNameservers = rootNameservers[:*rootTries]
+		}
 		// get zone file from root AXFR
 		// not all the root nameservers allow AXFR, try them until we find one that does
+		gotRoot := false
+	rootLoop:
 		for _, ns := range rootNameservers {
-			v("trying root nameserver %s", ns)
-			startTime := time.Now()
-			z, err = zone.RootAXFR(ns)
-			if err == nil {
+			addrs, err := nameserverAddrs(ns)
+			if err != nil {
+				logs.Info(logger.Fields{Nameserver: ns}, "unable to resolve root nameserver: %s", err)
+				continue
+			}
+			for _, addr := range addrs {
+				v(logger.VerbosityTrace, "trying root nameserver %s (%s)", ns, addr)
+				if ctx.Err() != nil {
+					break rootLoop
+				}
+				startTime := time.Now()
+				rootCtx, cancel := context.WithTimeout(ctx, *rootTimeout)
+				z, err = rootAXFR(rootCtx, ns, addr, zone.RootOptions{
+					Timeout:    *globalTimeout,
+					MaxRecords: *rootMaxRecs,
+					MaxSize:    *rootMaxSize,
+					SourceIP:   localIP,
+				})
+				cancel()
+				if err != nil {
+					logs.Info(logger.Fields{Nameserver: ns, IP: net.ParseIP(addr)}, "root zone transfer failed: %s", err)
+					continue
+				}
 				took := time.Since(startTime).Round(time.Millisecond)
-				log.Printf("ROOT %s xfr size: %d records in %s \n", ns, z.Records, took.String())
-				break
+				logs.Info(logger.Fields{Records: z.Records}, "ROOT %s xfr size: %d records in %s", ns, z.Records, took.String())
+				gotRoot = true
+				break rootLoop
+			}
+		}
+		if !gotRoot && ctx.Err() == nil {
+			// discard any records from a failed transfer
+			z = zone.Zone{}
+			if !*usePSL && len(*reverse) == 0 {
+				logs.Fatal(logger.Fields{}, "unable to transfer the root zone from any of the %d root servers tried, use -zonefile with a copy of the root zone or -psl to find zones to transfer", len(rootNameservers))
 			}
+			logs.Warn(logger.Fields{}, "unable to transfer the root zone from any of the %d root servers tried, only attempting the zones from -psl and -reverse", len(rootNameservers))
 		}
 	} else {
 		// zone file is provided
-		v("parsing zonefile: %q\n", *zonefile)
-		z, err = zone.ParseZoneFile(*zonefile)
+		v(logger.VerbosityDebug, "parsing zonefile: %q\n", *zonefile)
+		z, err = zone.ParseZoneFile(*zonefile, *zoneOrigin)
 		check(err)
 	}
 
-	if z.CountNS() == 0 {
-		log.Fatal("Got empty zone")
-	}
-
 	if *usePSL {
-		pslDomains, err := psl.GetDomains()
+		pslDomains, err := getPSLDomains()
 		check(err)
 		for _, domain := range pslDomains {
-			z.AddNS(domain, "")
+			z.AddNS(domain.Name, "")
 		}
-		v("added %d domains from PSL\n", len(pslDomains))
+		v(logger.VerbosityDebug, "added %d domains from PSL\n", len(pslDomains))
 	}
 
-	// create outpout dir if does not exist
-	if !*dryRun {
-		if _, err := os.Stat(*saveDir); os.IsNotExist(err) {
-			err = os.MkdirAll(*saveDir, os.ModePerm)
+	if len(*reverse) > 0 {
+		for _, cidr := range strings.Split(*reverse, ",") {
+			reverseZones, err := zone.ReverseZones(strings.TrimSpace(cidr))
 			check(err)
+			for _, domain := range reverseZones {
+				addReverseZone(&z, domain)
+			}
+			v(logger.VerbosityDebug, "added %d reverse zones for %s\n", len(reverseZones), cidr)
 		}
 	}
 
-	if *verbose {
-		z.PrintTree()
+	if z.CountNS() == 0 {
+		logs.Fatal(logger.Fields{}, "Got empty zone")
 	}
 
-	zoneChan := z.GetNameChan()
-	var g errgroup.Group
+	// create outpout dirs if they do not exist
+	if !*dryRun && newSink == nil {
+		for _, dir := range strings.Split(*saveDir, ",") {
+			if _, err := os.Stat(dir); os.IsNotExist(err) {
+				err = os.MkdirAll(dir, os.ModePerm)
+				check(err)
+			}
+		}
+	}
 
-	// start workers
-	for i := uint(0); i < *parallel; i++ {
-		g.Go(func() error { return worker(z, zoneChan) })
+	if *verbose >= logger.VerbosityTrace {
+		z.PrintTree()
 	}
 
-	err = g.Wait()
+	logs.SetUnicodeNames(unicodeNames)
+	results, err := scanner.Run(ctx, z)
 	check(err)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logs.Info(logger.Fields{}, "deadline reached, stopped early")
+	} else if ctx.Err() != nil {
+		logs.Info(logger.Fields{}, "interrupted, stopped early")
+	}
 	took := time.Since(start).Round(time.Millisecond)
-	log.Printf("%d / %d transferred in %s\n", totalXFR, len(z.NS), took.String())
-	v("exiting normally\n")
+	logs.Info(logger.Fields{}, "%d / %d attempted zones transferred with %d successful transfers in %s", results.ZonesTransferred, results.Attempted, results.Transferred, took.String())
+	if skipped := results.Zones - results.Attempted - int(results.ExcludedZones); skipped > 0 {
+		logs.Info(logger.Fields{}, "%d of %d zones were not attempted", skipped, results.Zones)
+	}
+	if excludes != nil {
+		logs.Info(logger.Fields{}, "excluded %d zones and %d nameserver IPs", results.ExcludedZones, results.ExcludedIPs)
+	}
+	if results.PrivateIPs > 0 {
+		logs.Info(logger.Fields{}, "skipped %d private or reserved nameserver IPs, use -allow-private to attempt them", results.PrivateIPs)
+	}
+	if results.GlueNameservers+results.MissingGlueNameservers > 0 {
+		logs.Info(logger.Fields{}, "%d nameservers had glue and %d did not, %d zones had no glue for any nameserver", results.GlueNameservers, results.MissingGlueNameservers, results.ZonesWithoutGlue)
+	}
+	if *dryRun {
+		allowed := results.Allowed()
+		logs.Info(logger.Fields{}, "%d nameserver IPs allow zone transfers", len(allowed))
+		err = printAllowed(allowed)
+		check(err)
+	}
+	if len(*summaryFile) > 0 {
+		err = writeSummary(*summaryFile, summary{Results: results, Unicode: unicodeNames})
+		check(err)
+		v(logger.VerbosityDebug, "saved summary to %s", *summaryFile)
+	}
+	v(logger.VerbosityDebug, "exiting normally\n")
+}
+
+func check(err error) {
+	if err != nil {
+		logs.Fatal(logger.Fields{}, "%s", err)
+	}
+}
+
+// v logs a line if the verbosity is at least level
+func v(level int, format string, v ...interface{}) {
+	if level >= logger.VerbosityTrace {
+		logs.Trace(logger.Fields{}, format, v...)
+	} else {
+		logs.Debug(logger.Fields{}, format, v...)
+	}
+}
+
+// verbosity is the -verbose level, it can be set as a boolean for level 1
+type verbosity int
+
+// verbosityFlag defines a verbosity flag with a name and an alias
+func verbosityFlag(name, alias, usage string) *verbosity {
+	level := new(verbosity)
+	flag.Var(level, name, usage)
+	flag.Var(level, alias, "alias for -"+name)
+	return level
+}
+
+func (l *verbosity) String() string {
+	if l == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*l))
+}
+
+func (l *verbosity) Set(value string) error {
+	if b, err := strconv.ParseBool(value); err == nil {
+		*l = 0
+		if b {
+			*l = logger.VerbosityDebug
+		}
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid verbosity %q", value)
+	}
+	*l = verbosity(n)
+	return nil
+}
+
+// IsBoolFlag allows the flag to be passed without a value
+func (l *verbosity) IsBoolFlag() bool {
+	return true
 }
 
-func worker(z zone.Zone, c chan string) error {
-	for {
-		domain, more := <-c
-		if !more {
-			return nil
+// nameserverAddrs returns the addresses of a root server or -server, resolving names with the configured nameserver
+// so that the system resolver is never used
+func nameserverAddrs(ns string) ([]string, error) {
+	if ip := net.ParseIP(ns); ip != nil {
+		if !scanner.IPAllowed(ip) {
+			return nil, nil
 		}
-		err := axfrWorker(z, domain)
+		return []string{ns}, nil
+	}
+	ips, err := scanner.LookupIP(ns)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	return addrs, nil
+}
+
+// rootAXFR transfers the root zone from the root server ns at addr, also saving it with -save-root
+func rootAXFR(ctx context.Context, ns, addr string, opts zone.RootOptions) (zone.Zone, error) {
+	if !*saveRoot || *dryRun {
+		return zone.RootAXFR(ctx, addr, opts)
+	}
+	sink, err := scanner.Sink(".", ns, net.ParseIP(addr))
+	if err != nil {
+		return zone.Zone{}, err
+	}
+	if sink == nil {
+		return zone.RootAXFR(ctx, addr, opts)
+	}
+	err = sink.WriteComment("Generated by ALLXFR (https://github.com/lanrat/allxfr)\n")
+	if err == nil {
+		err = sink.WriteCommentKey("nameserver", ns)
+	}
+	if err == nil {
+		err = sink.WriteCommentKey("nameserverIP", addr)
+	}
+	if err == nil {
+		err = sink.WriteCommentKey("xfr", "AXFR")
+	}
+	if err != nil {
+		sink.Abort()
+		return zone.Zone{}, err
+	}
+	var sinkErr error
+	opts.OnRecord = func(rr dns.RR) {
+		if sinkErr == nil {
+			sinkErr = sink.AddRR(rr)
+		}
+	}
+	z, err := zone.RootAXFR(ctx, addr, opts)
+	if err == nil {
+		err = sinkErr
+	}
+	if err != nil {
+		sink.Abort()
+		return z, err
+	}
+	return z, sink.Finish()
+}
+
+// serverZone returns a zone with each of zones delegated only to server, which may be a hostname or an IP
+func serverZone(server string, zones []string) (zone.Zone, error) {
+	var z zone.Zone
+	nameserver := server
+	if net.ParseIP(server) == nil {
+		var err error
+		nameserver, err = asciiDomain(server)
+		if err != nil {
+			return z, err
+		}
+	}
+	addrs, err := nameserverAddrs(nameserver)
+	if err != nil {
+		return z, err
+	}
+	if len(addrs) == 0 {
+		return z, fmt.Errorf("no usable addresses for server %s", server)
+	}
+	for _, addr := range addrs {
+		z.AddIP(nameserver, net.ParseIP(addr))
+	}
+	for _, domain := range zones {
+		domain, err := asciiDomain(domain)
 		if err != nil {
-			return err
+			return z, err
 		}
+		z.AddTarget(domain)
+		z.AddNS(domain, nameserver)
 	}
+	return z, nil
 }
 
-func check(err error) {
+// asciiDomain returns the fully qualified ASCII form of a domain given on the command line
+// internationalized names are converted to punycode and their Unicode form is kept in unicodeNames for the output
+func asciiDomain(name string) (string, error) {
+	ascii, err := publicsuffix.ToASCII(strings.ToLower(strings.TrimSuffix(name, ".")))
+	if err == nil {
+		ascii = dns.Fqdn(ascii)
+		if _, ok := dns.IsDomainName(ascii); !ok {
+			err = errors.New("not a valid domain name")
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid domain %q: %w", name, err)
+	}
+	if !strings.EqualFold(ascii, dns.Fqdn(name)) {
+		unicodeNames[ascii] = strings.ToLower(dns.Fqdn(name))
+		logs.Info(logger.Fields{}, "using %s for %s", ascii, name)
+	}
+	return ascii, nil
+}
+
+// s3Sink returns a SinkFactory uploading zones to bucket with the same names as in -out
+func s3Sink(bucket *save.S3Bucket) scan.SinkFactory {
+	return func(zone, nameserver string, ip net.IP) (save.Sink, error) {
+		name := scanner.ZonePath(zone, nameserver, ip)
+		if !*overwrite {
+			exists, err := bucket.Exists(name)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				v(logger.VerbosityDebug, "object %q exists, skipping", name)
+				return nil, nil
+			}
+		}
+		return bucket.New(zone, name, save.Options{
+			Sort:         *sortZone,
+			Meta:         *saveMeta,
+			GzipLevel:    max(*gzipLevel, 0),
+			Uncompressed: *gzipLevel == 0,
+			FileLimit:    scanner.FileLimit(),
+		})
+	}
+}
+
+// addReverseZone adds a reverse zone to z along with its nameservers and their IPs
+// errors resolving the nameservers are logged and the zone is still added
+func addReverseZone(z *zone.Zone, domain string) {
+	z.AddTarget(domain)
+	nameservers, err := scanner.LookupNS(domain)
 	if err != nil {
-		log.Fatal(err)
+		logs.Debug(logger.Fields{Zone: domain}, "%s", err)
+		return
+	}
+	for _, nameserver := range nameservers {
+		z.AddNS(domain, nameserver)
+		ips, err := scanner.LookupIP(nameserver)
+		if err != nil {
+			logs.Debug(logger.Fields{Zone: domain}, "%s", err)
+		}
+		for _, ip := range ips {
+			z.AddIP(nameserver, ip)
+		}
 	}
 }
 
-func v(format string, v ...interface{}) {
-	if *verbose {
-		line := fmt.Sprintf(format, v...)
-		lines := strings.ReplaceAll(line, "\n", "\n\t")
-		log.Print(lines)
+// getPSLDomains returns the domains in the public suffix list from -psl-file or by downloading it
+func getPSLDomains() ([]psl.Domain, error) {
+	opts := psl.Options{
+		Private: *pslPrivate,
+		Logger:  logs,
+	}
+	if len(*pslTLDs) > 0 {
+		opts.TLDs = strings.Split(*pslTLDs, ",")
+	}
+	var domains []psl.Domain
+	var invalid int
+	var err error
+	if len(*pslFile) == 0 {
+		domains, invalid, err = psl.GetDomains(*pslCache, *pslCacheTTL, opts)
+	} else {
+		var file *os.File
+		file, err = os.Open(*pslFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		domains, invalid, err = psl.GetDomainsFromReader(file, opts)
+	}
+	if invalid > 0 {
+		logs.Warn(logger.Fields{}, "skipped %d invalid public suffix list entries", invalid)
+	}
+	return domains, err
+}
+
+// defaultPSLCache returns the default -psl-cache location in the user's cache directory
+func defaultPSLCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
 	}
+	return filepath.Join(dir, "allxfr", "psl.dat")
 }
 
 // getNameserver returns the nameserver passed via flag if provided, if not returns the system's NS
@@ -1,39 +1,262 @@
 package psl
 
 import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lanrat/allxfr/logger"
 
 	"github.com/miekg/dns"
 	"github.com/weppos/publicsuffix-go/publicsuffix"
 )
 
-const pslURL = "https://publicsuffix.org/list/public_suffix_list.dat"
+// pslURL is where the list is downloaded from, a variable so tests can serve their own list
+var pslURL = "https://publicsuffix.org/list/public_suffix_list.dat"
+
+// Domain is a public suffix and the section of the list it was found in
+type Domain struct {
+	// Name is the fully qualified ASCII form of the suffix
+	Name string
+	// Private is true for domains from the private section of the list and false for ICANN domains
+	Private bool
+}
+
+// Options select which domains in the list are returned
+type Options struct {
+	// Private includes the domains from the private section of the list
+	Private bool
+	// TLDs limits the domains to those under one of these TLDs, all domains are returned if empty
+	TLDs []string
+	// Logger is used to report falling back to the cached list and invalid entries, a human readable logger to stderr is used if not set
+	Logger *logger.Logger
+}
+
+// logger returns the Logger or the default logger if not set
+func (o Options) logger() *logger.Logger {
+	if o.Logger == nil {
+		return logger.New(os.Stderr, false, 0)
+	}
+	return o.Logger
+}
 
-func GetDomains() ([]string, error) {
-	resp, err := http.Get(pslURL)
+// GetDomains returns the domains in the public suffix list selected by opts and the number of invalid entries skipped
+// if cacheFile is set the list is saved there and only downloaded again once it is older than ttl,
+// and then only if it changed upstream. If the download fails the cached copy is used.
+func GetDomains(cacheFile string, ttl time.Duration, opts Options) ([]Domain, int, error) {
+	var data []byte
+	var err error
+	if len(cacheFile) == 0 {
+		data, _, err = download(nil)
+	} else {
+		data, err = cachedDownload(cacheFile, ttl, opts.logger())
+	}
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	defer resp.Body.Close()
+	return GetDomainsFromReader(bytes.NewReader(data), opts)
+}
 
+// GetDomainsFromReader returns the domains selected by opts in a public suffix list read from r
+// and the number of invalid entries skipped, each of which is logged
+func GetDomainsFromReader(r io.Reader, opts Options) ([]Domain, int, error) {
 	list := publicsuffix.NewList()
 	options := &publicsuffix.ParserOption{
-		PrivateDomains: false,
+		PrivateDomains: opts.Private,
 	}
-	rules, err := list.Load(resp.Body, options)
+	rules, err := list.Load(r, options)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	out := make([]string, 0, len(rules))
+	tlds := make(map[string]bool, len(opts.TLDs))
+	for _, tld := range opts.TLDs {
+		tld, err = publicsuffix.ToASCII(strings.Trim(strings.ToLower(tld), "."))
+		if err != nil {
+			return nil, 0, err
+		}
+		tlds[tld] = true
+	}
+
+	l := opts.logger()
+	var invalid int
+	out := make([]Domain, 0, len(rules))
 	for _, rule := range rules {
 		if rule.Type != publicsuffix.ExceptionType {
 			domain, err := publicsuffix.ToASCII(rule.Value)
 			if err != nil {
-				return out, err
+				l.Warn(logger.Fields{}, "skipping invalid public suffix list entry %q: %s", rule.Value, err)
+				invalid++
+				continue
+			}
+			if !validDomain(domain) {
+				l.Warn(logger.Fields{}, "skipping invalid public suffix list entry %q: not a valid domain name", rule.Value)
+				invalid++
+				continue
 			}
-			out = append(out, dns.Fqdn(domain))
+			if len(tlds) > 0 && !tlds[domain[strings.LastIndex(domain, ".")+1:]] {
+				continue
+			}
+			out = append(out, Domain{
+				Name:    dns.Fqdn(domain),
+				Private: rule.Private,
+			})
 		}
 	}
-	return out, nil
+	return out, invalid, nil
+}
+
+// validDomain returns true if domain is a non-empty ASCII domain name without empty labels
+func validDomain(domain string) bool {
+	if len(domain) == 0 || strings.Contains(domain, "..") || strings.HasPrefix(domain, ".") {
+		return false
+	}
+	for _, c := range domain {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	_, ok := dns.IsDomainName(domain)
+	return ok
+}
+
+// validators are the response headers used to make a conditional request for the list
+type validators struct {
+	etag         string
+	lastModified string
+}
+
+// download fetches the list, if v is set a conditional request is made and nil data is returned if it is unchanged
+func download(v *validators) ([]byte, *validators, error) {
+	req, err := http.NewRequest(http.MethodGet, pslURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if v != nil {
+		if len(v.etag) > 0 {
+			req.Header.Set("If-None-Match", v.etag)
+		}
+		if len(v.lastModified) > 0 {
+			req.Header.Set("If-Modified-Since", v.lastModified)
+		}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, v, nil
+	case http.StatusOK:
+	default:
+		return nil, nil, fmt.Errorf("unexpected response downloading %s: %s", pslURL, resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, &validators{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// cachedDownload returns the list from cacheFile, refreshing it once it is older than ttl
+// failing to update cacheFile is only logged, as the list was still downloaded
+func cachedDownload(cacheFile string, ttl time.Duration, l *logger.Logger) ([]byte, error) {
+	cached, cacheErr := os.ReadFile(cacheFile)
+	if cacheErr == nil {
+		info, err := os.Stat(cacheFile)
+		if err == nil && time.Since(info.ModTime()) < ttl {
+			return cached, nil
+		}
+	}
+
+	var v *validators
+	if cacheErr == nil {
+		v = readValidators(validatorsFilename(cacheFile))
+	}
+	data, newValidators, err := download(v)
+	if err != nil {
+		if cacheErr == nil {
+			l.Warn(logger.Fields{}, "unable to update public suffix list, using cached copy %s: %s", cacheFile, err)
+			return cached, nil
+		}
+		return nil, err
+	}
+	if data == nil {
+		// not modified, restart the ttl
+		now := time.Now()
+		err = os.Chtimes(cacheFile, now, now)
+		if err != nil {
+			l.Warn(logger.Fields{}, "unable to update public suffix list cache %s: %s", cacheFile, err)
+		}
+		return cached, nil
+	}
+
+	err = writeCache(cacheFile, data, newValidators)
+	if err != nil {
+		l.Warn(logger.Fields{}, "unable to save public suffix list cache %s: %s", cacheFile, err)
+	}
+	return data, nil
+}
+
+// validatorsFilename returns the file the validators for cacheFile are stored in
+func validatorsFilename(cacheFile string) string {
+	return cacheFile + ".validators"
+}
+
+// readValidators returns the saved validators, or nil if there are none
+func readValidators(filename string) *validators {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	v := new(validators)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ": ")
+		if !found {
+			continue
+		}
+		switch key {
+		case "ETag":
+			v.etag = value
+		case "Last-Modified":
+			v.lastModified = value
+		}
+	}
+	return v
+}
+
+// writeCache atomically saves the list and its validators
+func writeCache(cacheFile string, data []byte, v *validators) error {
+	err := os.MkdirAll(filepath.Dir(cacheFile), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(cacheFile, data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(validatorsFilename(cacheFile), []byte(fmt.Sprintf("ETag: %s\nLast-Modified: %s\n", v.etag, v.lastModified)))
+}
+
+// writeFileAtomic writes data to a temporary file and then renames it to filename
+func writeFileAtomic(filename string, data []byte) error {
+	tmp := fmt.Sprintf("%s.tmp", filename)
+	err := os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
 }
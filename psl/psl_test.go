@@ -0,0 +1,67 @@
+package psl
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lanrat/allxfr/logger"
+)
+
+const testList = "// ===BEGIN ICANN DOMAINS===\ncom\nco.uk\n// ===END ICANN DOMAINS===\n"
+
+// serveList serves testList as the public suffix list until the test finishes
+func serveList(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testList))
+	}))
+	t.Cleanup(srv.Close)
+	old := pslURL
+	pslURL = srv.URL
+	t.Cleanup(func() { pslURL = old })
+}
+
+func TestGetDomainsUnwritableCache(t *testing.T) {
+	serveList(t)
+	// a directory can not be created under a regular file, even by root
+	dir := t.TempDir()
+	notDir := filepath.Join(dir, "file")
+	err := os.WriteFile(notDir, nil, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	opts := Options{Logger: logger.New(&logs, false, 0)}
+	domains, _, err := GetDomains(filepath.Join(notDir, "allxfr", "psl.dat"), time.Hour, opts)
+	if err != nil {
+		t.Fatalf("unwritable cache failed the download: %s", err)
+	}
+	if len(domains) != 2 {
+		t.Errorf("got domains %v, want com. and co.uk.", domains)
+	}
+	if !strings.Contains(logs.String(), "unable to save public suffix list cache") {
+		t.Errorf("cache failure not logged, got %q", logs.String())
+	}
+}
+
+func TestGetDomainsCache(t *testing.T) {
+	serveList(t)
+	cacheFile := filepath.Join(t.TempDir(), "psl.dat")
+	opts := Options{Logger: logger.New(&bytes.Buffer{}, false, 0)}
+	_, _, err := GetDomains(cacheFile, time.Hour, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := os.ReadFile(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(cached) != testList {
+		t.Errorf("cached %q, want %q", cached, testList)
+	}
+}
@@ -0,0 +1,35 @@
+package save
+
+// FileLimit limits the number of zone files that are open at the same time, it is shared between Files
+// a nil FileLimit does not limit anything
+type FileLimit struct {
+	slots chan struct{}
+}
+
+// NewFileLimit returns a FileLimit allowing n open files, or nil if n is not positive
+func NewFileLimit(n int) *FileLimit {
+	if n <= 0 {
+		return nil
+	}
+	return &FileLimit{slots: make(chan struct{}, n)}
+}
+
+// DefaultFileLimit returns half of the process's soft limit on open files, leaving the rest for connections,
+// or 0 if it is not known
+func DefaultFileLimit() int {
+	return int(openFileLimit() / 2)
+}
+
+// acquire waits until a file can be opened
+func (l *FileLimit) acquire() {
+	if l != nil {
+		l.slots <- struct{}{}
+	}
+}
+
+// release allows another file to be opened
+func (l *FileLimit) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
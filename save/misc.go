@@ -1,7 +1,11 @@
 package save
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/miekg/dns"
 )
@@ -18,3 +22,46 @@ func RRString(rr dns.RR) string {
 	}
 	return rr.String()
 }
+
+// rdataString returns the presentation format of the record without its header
+func rdataString(rr dns.RR) string {
+	return strings.TrimPrefix(RRString(rr), rr.Header().String())
+}
+
+// CanonicalRecords returns the records in presentation format with lowercase owner names, sorted and without duplicates
+// the same record set always gives the same result regardless of the order or case it was received in
+func CanonicalRecords(rrs []dns.RR) []string {
+	seen := make(map[string]bool, len(rrs))
+	out := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		line := canonicalString(rr)
+		if !seen[line] {
+			seen[line] = true
+			out = append(out, line)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// HashRecords returns the hex encoded SHA-256 of records as returned by CanonicalRecords
+func HashRecords(records []string) string {
+	h := sha256.New()
+	for _, record := range records {
+		h.Write([]byte(record))
+		h.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// canonicalString returns the presentation format of the record with its owner name in lowercase
+func canonicalString(rr dns.RR) string {
+	name := rr.Header().Name
+	lower := strings.ToLower(name)
+	if name == lower {
+		return RRString(rr)
+	}
+	rr = dns.Copy(rr)
+	rr.Header().Name = lower
+	return RRString(rr)
+}
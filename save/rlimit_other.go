@@ -0,0 +1,8 @@
+//go:build !unix
+
+package save
+
+// openFileLimit returns 0 as the limit on open files is not known
+func openFileLimit() uint64 {
+	return 0
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package save
+
+import "syscall"
+
+// openFileLimit returns the soft limit on open files or 0 if it is not known
+func openFileLimit() uint64 {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0
+	}
+	if limit.Cur > 1<<30 {
+		// effectively unlimited
+		return 1 << 30
+	}
+	return limit.Cur
+}
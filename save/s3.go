@@ -0,0 +1,206 @@
+package save
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Bucket saves zone files as objects under a prefix in an S3 bucket
+type S3Bucket struct {
+	ctx    context.Context
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// IsS3URL returns true if location is an s3://bucket/prefix URL
+func IsS3URL(location string) bool {
+	return strings.HasPrefix(location, "s3://")
+}
+
+// NewS3Bucket returns the S3Bucket for a s3://bucket/prefix URL
+// credentials and the region are loaded from the standard AWS environment variables, shared config files and instance roles
+// ctx is used for every request to the bucket
+func NewS3Bucket(ctx context.Context, location string) (*S3Bucket, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid S3 URL %q, expected s3://bucket/prefix", location)
+	}
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Bucket{
+		ctx:    ctx,
+		client: s3.NewFromConfig(cfg),
+		bucket: u.Host,
+		prefix: strings.Trim(u.Path, "/"),
+	}, nil
+}
+
+// key returns the object key of name under the prefix
+func (b *S3Bucket) key(name string) string {
+	return path.Join(b.prefix, name)
+}
+
+// Exists returns true if an object named name exists under the prefix
+func (b *S3Bucket) Exists(name string) (bool, error) {
+	_, err := b.client.HeadObject(b.ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(b.key(name)),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// New returns a Sink that writes the zone to a temporary file and uploads it as the object named name on Finish
+// nothing is uploaded if the zone is aborted or has no records, DiffBase is not supported
+func (b *S3Bucket) New(zone, name string, opts Options) (*S3File, error) {
+	if len(opts.DiffBase) > 0 {
+		return nil, errors.New("diffs can not be saved to S3")
+	}
+	dir, err := os.MkdirTemp("", "allxfr-")
+	if err != nil {
+		return nil, err
+	}
+	return &S3File{
+		File:   New(zone, filepath.Join(dir, path.Base(name)), opts),
+		bucket: b,
+		name:   name,
+		dir:    dir,
+	}, nil
+}
+
+// ensure S3File implements PartialSink
+var _ PartialSink = (*S3File)(nil)
+
+// S3File is a Sink that uploads the zone file to S3 once it is finished
+type S3File struct {
+	*File
+	bucket *S3Bucket
+	name   string
+	// dir is the temporary directory holding the zone file until it is uploaded
+	dir string
+	// pending is set when the zone file is finished but has not been uploaded yet
+	pending bool
+}
+
+// s3UploadTries is the number of times each file is uploaded before giving up
+const s3UploadTries = 3
+
+// Finish finishes the zone file and uploads it and its metadata file if it has records
+// if the upload fails the zone file is kept so calling Finish again retries the upload, Abort discards it
+func (f *S3File) Finish() error {
+	if f.closed && !f.pending {
+		return nil
+	}
+	if !f.closed {
+		err := f.File.Finish()
+		if err != nil {
+			os.RemoveAll(f.dir)
+			return err
+		}
+		if f.records <= 1 {
+			return os.RemoveAll(f.dir)
+		}
+		f.pending = true
+	}
+	return f.uploadZone()
+}
+
+// KeepPartial finishes the incomplete zone file and uploads it and its metadata file as PartialFilename
+// if the upload fails calling Finish retries it
+func (f *S3File) KeepPartial(reason string) error {
+	if f.closed {
+		return nil
+	}
+	err := f.File.KeepPartial(reason)
+	if err != nil {
+		os.RemoveAll(f.dir)
+		return err
+	}
+	if f.records == 0 {
+		return os.RemoveAll(f.dir)
+	}
+	f.name = PartialFilename(f.name)
+	f.pending = true
+	return f.uploadZone()
+}
+
+// uploadZone uploads the finished zone file and its metadata file and removes them once both are uploaded
+func (f *S3File) uploadZone() error {
+	err := f.upload(f.filename, f.name)
+	if err != nil {
+		return err
+	}
+	if f.opts.Meta {
+		err = f.upload(MetaFilename(f.filename), MetaFilename(f.name))
+		if err != nil {
+			return err
+		}
+	}
+	f.pending = false
+	return os.RemoveAll(f.dir)
+}
+
+// Abort discards the zone without uploading anything, including a zone whose upload failed
+func (f *S3File) Abort() error {
+	defer os.RemoveAll(f.dir)
+	f.pending = false
+	return f.File.Abort()
+}
+
+// upload saves the local file as the object named name, trying up to s3UploadTries times
+func (f *S3File) upload(filename, name string) error {
+	var err error
+	for try := 0; try < s3UploadTries; try++ {
+		if try > 0 {
+			select {
+			case <-f.bucket.ctx.Done():
+				return err
+			case <-time.After(time.Duration(try) * time.Second):
+			}
+		}
+		err = f.putObject(filename, name)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// putObject uploads the local file as the object named name
+func (f *S3File) putObject(filename, name string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = f.bucket.client.PutObject(f.bucket.ctx, &s3.PutObjectInput{
+		Bucket: aws.String(f.bucket.bucket),
+		Key:    aws.String(f.bucket.key(name)),
+		Body:   file,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to upload %s to s3://%s/%s: %w", f.File.zone, f.bucket.bucket, f.bucket.key(name), err)
+	}
+	return nil
+}
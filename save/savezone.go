@@ -3,32 +3,100 @@ package save
 import (
 	"bufio"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/lanrat/allxfr/zone"
+
 	"github.com/miekg/dns"
 )
 
+// Options controls how a zone file is written
+type Options struct {
+	// Sort holds every record in memory until Finish and then writes them ordered by name, type and rdata
+	// so that dumps of the same zone can be diffed. Memory use grows with the size of the zone.
+	Sort bool
+	// Meta writes every metadata comment key to a JSON file next to the zone file on Finish
+	Meta bool
+	// GzipLevel is the gzip compression level from gzip.BestSpeed to gzip.BestCompression, 0 for the default level
+	GzipLevel int
+	// Uncompressed writes a plain text zone file instead of gzip
+	Uncompressed bool
+	// DiffBase is a previously saved zone file, when set the records are held in memory until Finish
+	// and then only the records added and removed since DiffBase are written, prefixed with + and -
+	DiffBase string
+	// FileLimit is waited on before the zone file is created and released once it is closed
+	FileLimit *FileLimit
+}
+
+// Sink receives the comments and records of a single zone transfer
+// after Abort or Finish the write methods return ErrFileClosed
+type Sink interface {
+	// WriteComment adds a comment line, comment includes the trailing newline
+	WriteComment(comment string) error
+	// WriteCommentKey adds a key: value metadata comment
+	WriteCommentKey(key, value string) error
+	// AddRR adds a record
+	AddRR(rr dns.RR) error
+	// Records returns the number of records added
+	Records() int64
+	// Finish saves the zone, a zone without records is discarded
+	Finish() error
+	// Abort discards the zone
+	Abort() error
+}
+
+// PartialSink is a Sink that can keep an incomplete zone instead of discarding it
+type PartialSink interface {
+	Sink
+	// KeepPartial saves the records received so far with reason as the error metadata comment
+	KeepPartial(reason string) error
+}
+
+// ensure File implements PartialSink
+var _ PartialSink = (*File)(nil)
+
 // File represents the zone file to create on disk
 type File struct {
 	filename    string
 	filenameTmp string
 	zone        string
+	opts        Options
 	bufWriter   *bufio.Writer
 	gzWriter    *gzip.Writer
 	fileWriter  *os.File
 	records     int64
 	closed      bool
+	// partial is set by KeepPartial to save a zone with a single record
+	partial bool
+	// opened is true while holding a slot of the FileLimit
+	opened bool
+	// rrs holds the records until Finish when sorting
+	rrs []dns.RR
+	// meta holds the metadata comment keys for the JSON metadata file
+	meta map[string]string
+	// hash is the SHA-256 of the canonical text of the records in the order they are written
+	hash hash.Hash
 }
 
 // New returns a handle to a new zonefile
-func New(zone, filename string) *File {
+func New(zone, filename string, opts Options) *File {
 	f := new(File)
 	f.filename = filename
 	f.filenameTmp = fmt.Sprintf("%s.tmp", f.filename)
 	f.zone = zone
+	f.opts = opts
+	f.meta = make(map[string]string)
+	f.hash = sha256.New()
 	return f
 }
 
@@ -49,7 +117,57 @@ func (f *File) WriteComment(comment string) error {
 
 // WriteCommentKey adds a comment to the zone file
 func (f *File) WriteCommentKey(key, value string) error {
-	return f.WriteComment(fmt.Sprintf("%s: %s\n", key, value))
+	err := f.WriteComment(fmt.Sprintf("%s: %s\n", key, value))
+	if err != nil {
+		return err
+	}
+	f.meta[key] = value
+	return nil
+}
+
+// MetaFilename returns the name of the JSON metadata file written for a zone file
+func MetaFilename(filename string) string {
+	name := strings.TrimSuffix(filename, ".gz")
+	if !strings.HasSuffix(name, "zone") {
+		return name + ".meta.json"
+	}
+	return strings.TrimSuffix(name, "zone") + "meta.json"
+}
+
+// PartialFilename returns the name of the file an incomplete zone file is kept in by KeepPartial
+func PartialFilename(filename string) string {
+	ext := ""
+	if strings.HasSuffix(filename, ".gz") {
+		ext = ".gz"
+	}
+	name := strings.TrimSuffix(filename, ext)
+	if !strings.HasSuffix(name, "zone") {
+		return name + ".partial" + ext
+	}
+	return strings.TrimSuffix(name, "zone") + "partial.zone" + ext
+}
+
+// writeMeta atomically writes the metadata comment keys as a JSON object, integer values are written as numbers
+func (f *File) writeMeta() error {
+	out := make(map[string]interface{}, len(f.meta))
+	for key, value := range f.meta {
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			out[key] = n
+		} else {
+			out[key] = value
+		}
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := MetaFilename(f.filename)
+	tmp := fmt.Sprintf("%s.tmp", filename)
+	err = os.WriteFile(tmp, append(data, '\n'), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
 }
 
 // ErrFileClosed returned when attempting to write to a closed file
@@ -63,14 +181,31 @@ func (f *File) fileReady() error {
 		return ErrFileClosed
 	}
 	if f.bufWriter == nil {
+		f.opts.FileLimit.acquire()
+		f.opened = true
 		f.fileWriter, err = os.Create(f.filenameTmp)
 		if err != nil {
+			f.releaseFile()
 			return err
 		}
-		f.gzWriter = gzip.NewWriter(f.fileWriter)
-		f.gzWriter.ModTime = time.Now()
-		f.gzWriter.Name = fmt.Sprintf("%s.zone", f.zone[:len(f.zone)-1])
-		f.bufWriter = bufio.NewWriter(f.gzWriter)
+		if f.opts.Uncompressed {
+			f.bufWriter = bufio.NewWriter(f.fileWriter)
+		} else {
+			level := f.opts.GzipLevel
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			f.gzWriter, err = gzip.NewWriterLevel(f.fileWriter, level)
+			if err != nil {
+				f.fileWriter.Close()
+				os.Remove(f.filenameTmp)
+				f.releaseFile()
+				return err
+			}
+			f.gzWriter.ModTime = time.Now()
+			f.gzWriter.Name = fmt.Sprintf("%s.zone", f.zone[:len(f.zone)-1])
+			f.bufWriter = bufio.NewWriter(f.gzWriter)
+		}
 		// Save metadata to zone file as comment
 		err = f.WriteCommentKey("timestamp", time.Now().Format(time.RFC3339))
 		if err != nil {
@@ -92,7 +227,12 @@ func (f *File) AddRR(rr dns.RR) error {
 		return err
 	}
 
-	_, err = f.bufWriter.WriteString(fmt.Sprintf("%s\n", RRString(rr)))
+	if f.opts.Sort || len(f.opts.DiffBase) > 0 {
+		f.rrs = append(f.rrs, rr)
+		f.records++
+		return nil
+	}
+	err = f.writeRR(rr)
 	if err != nil {
 		return err
 	}
@@ -100,21 +240,168 @@ func (f *File) AddRR(rr dns.RR) error {
 	return nil
 }
 
+// writeRR writes a record to the zone file and adds its canonical text to the hash
+func (f *File) writeRR(rr dns.RR) error {
+	line := RRString(rr)
+	f.hashRR(rr, line)
+	_, err := f.bufWriter.WriteString(line + "\n")
+	return err
+}
+
+// hashRR adds the canonical text of rr to the hash, line is its presentation format
+func (f *File) hashRR(rr dns.RR, line string) {
+	if name := rr.Header().Name; name != strings.ToLower(name) {
+		line = canonicalString(rr)
+	}
+	f.hash.Write([]byte(line))
+	f.hash.Write([]byte("\n"))
+}
+
+// writeSorted writes the buffered records ordered by name, type and rdata, keeping the leading SOA first
+func (f *File) writeSorted() error {
+	if len(f.rrs) == 0 {
+		return nil
+	}
+	rest := f.rrs[1:]
+	if _, ok := f.rrs[0].(*dns.SOA); !ok {
+		rest = f.rrs
+	}
+	sortRRs(rest)
+	for _, rr := range f.rrs {
+		err := f.writeRR(rr)
+		if err != nil {
+			return err
+		}
+	}
+	f.rrs = nil
+	return nil
+}
+
+// writeDiff writes the records added and removed since DiffBase
+func (f *File) writeDiff() error {
+	old, err := zone.ReadRecords(f.opts.DiffBase, f.zone)
+	if err != nil {
+		return err
+	}
+	// the hash is of the new zone and not the diff
+	for _, rr := range f.rrs {
+		f.hashRR(rr, RRString(rr))
+	}
+	added, removed := zone.Diff(CanonicalRecords(old), CanonicalRecords(f.rrs))
+	f.rrs = nil
+	err = f.WriteCommentKey("diff_base", f.opts.DiffBase)
+	if err != nil {
+		return err
+	}
+	err = f.WriteCommentKey("added", fmt.Sprintf("%d", len(added)))
+	if err != nil {
+		return err
+	}
+	err = f.WriteCommentKey("removed", fmt.Sprintf("%d", len(removed)))
+	if err != nil {
+		return err
+	}
+	for _, record := range removed {
+		_, err = f.bufWriter.WriteString("- " + record + "\n")
+		if err != nil {
+			return err
+		}
+	}
+	for _, record := range added {
+		_, err = f.bufWriter.WriteString("+ " + record + "\n")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortRRs sorts records by owner name, type and then rdata
+func sortRRs(rrs []dns.RR) {
+	sort.SliceStable(rrs, func(i, j int) bool {
+		hi, hj := rrs[i].Header(), rrs[j].Header()
+		ni, nj := strings.ToLower(hi.Name), strings.ToLower(hj.Name)
+		if ni != nj {
+			return ni < nj
+		}
+		if hi.Rrtype != hj.Rrtype {
+			return hi.Rrtype < hj.Rrtype
+		}
+		return rdataString(rrs[i]) < rdataString(rrs[j])
+	})
+}
+
 // Abort stops processing the new zone file and removes it from disk
 func (f *File) Abort() error {
 	f.records = 0 // forces finish to remove the file
 	return f.Finish()
 }
 
+// KeepPartial stops processing the zone file and saves the records written so far to PartialFilename
+// the records are saved in the order they were received, without sorting or diffing
+func (f *File) KeepPartial(reason string) error {
+	if f.closed {
+		return nil
+	}
+	err := f.WriteCommentKey("error", reason)
+	if err != nil {
+		return err
+	}
+	for _, rr := range f.rrs {
+		err = f.writeRR(rr)
+		if err != nil {
+			return err
+		}
+	}
+	f.rrs = nil
+	f.opts.Sort = false
+	f.opts.DiffBase = ""
+	f.partial = true
+	f.filename = PartialFilename(f.filename)
+	return f.Finish()
+}
+
+// releaseFile releases the FileLimit slot if held
+func (f *File) releaseFile() {
+	if f.opened {
+		f.opened = false
+		f.opts.FileLimit.release()
+	}
+}
+
 // Finish adds closing comments and flushes and closes all buffers/files
 func (f *File) Finish() error {
 	if f.closed {
 		return nil
 	}
+	defer f.releaseFile()
+	// a zone with only an SOA is discarded unless partial
+	keep := f.records > 1 || (f.partial && f.records > 0)
 	// function to finish/close/safe the files when done
-	if f.records > 1 {
+	if keep {
+		if len(f.opts.DiffBase) > 0 {
+			err := f.writeDiff()
+			if err != nil {
+				return err
+			}
+		} else if f.opts.Sort {
+			err := f.writeSorted()
+			if err != nil {
+				return err
+			}
+			// the closing SOA of an AXFR is no longer the last record
+			err = f.WriteCommentKey("sorted", "true")
+			if err != nil {
+				return err
+			}
+		}
+		// identical record streams hash the same regardless of owner name case, sorting makes it independent of order
+		err := f.WriteCommentKey("sha256", hex.EncodeToString(f.hash.Sum(nil)))
+		if err != nil {
+			return err
+		}
 		// save record count comment at end of zone file
-		err := f.WriteCommentKey("records", fmt.Sprintf("%d", f.records))
+		err = f.WriteCommentKey("records", fmt.Sprintf("%d", f.records))
 		if err != nil {
 			return err
 		}
@@ -125,21 +412,26 @@ func (f *File) Finish() error {
 		if err != nil {
 			return err
 		}
-		err = f.gzWriter.Flush()
-		if err != nil {
-			return err
-		}
-		err = f.gzWriter.Close()
-		if err != nil {
-			return err
+		if f.gzWriter != nil {
+			err = f.gzWriter.Flush()
+			if err != nil {
+				return err
+			}
+			err = f.gzWriter.Close()
+			if err != nil {
+				return err
+			}
 		}
 		err = f.fileWriter.Close()
 		if err != nil {
 			return err
 		}
 	}
-	if f.records > 1 {
+	if keep {
 		err = os.Rename(f.filenameTmp, f.filename)
+		if err == nil && f.opts.Meta {
+			err = f.writeMeta()
+		}
 	} else {
 		err = os.Remove(f.filenameTmp)
 	}
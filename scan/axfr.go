@@ -0,0 +1,835 @@
+package scan
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/lanrat/allxfr/logger"
+	"github.com/lanrat/allxfr/save"
+	"github.com/lanrat/allxfr/zone"
+
+	"github.com/miekg/dns"
+)
+
+// XfrError is a zone transfer failure caused by the remote server or the network
+// these are expected for most zones and are not fatal to the scan
+type XfrError struct {
+	// Refused is true when the server answered the transfer request with an error rcode
+	Refused bool
+	// Rcode is the error rcode the server answered with when Refused, such as dns.RcodeRefused or dns.RcodeNotAuth
+	Rcode int
+	// Timeout is true when the server stopped answering
+	Timeout bool
+	// Truncated is true when the server closed the transfer before the closing SOA and the records were discarded
+	Truncated bool
+	// Permanent is true when retrying would give the same result
+	Permanent bool
+	err       error
+}
+
+func (e *XfrError) Error() string {
+	return e.err.Error()
+}
+
+func (e *XfrError) Unwrap() error {
+	return e.err
+}
+
+// newXfrError wraps a transfer error from zone and ip
+func newXfrError(zone string, ip net.IP, err error) *XfrError {
+	var rcode rcodeError
+	refused := errors.As(err, &rcode)
+	var netErr net.Error
+	return &XfrError{
+		Refused:   refused,
+		Rcode:     int(rcode),
+		Timeout:   errors.As(err, &netErr) && netErr.Timeout(),
+		Permanent: refused || isHardNetError(err) || errors.Is(err, dns.ErrSoa),
+		err:       fmt.Errorf("transfer error from zone: %s ip: %s: %w", zone, ip.String(), err),
+	}
+}
+
+// RcodeString returns the name of the rcode the transfer was refused with, or an empty string if it was not refused
+func (e *XfrError) RcodeString() string {
+	if !e.Refused {
+		return ""
+	}
+	return rcodeName(e.Rcode)
+}
+
+// failureClass returns a short classification of a failed transfer for its failure reason, or an empty string
+// a server that refuses the transfer but answers the zone's SOA is serving the zone with a transfer ACL,
+// while one that also fails the SOA query is likely not serving the zone to anyone
+func (s *Scanner) failureClass(domain string, ip net.IP, xerr *XfrError) string {
+	switch {
+	case xerr.Refused:
+		_, err := s.querySerial(net.JoinHostPort(ip.String(), s.port), domain)
+		if err != nil {
+			s.log.Debug(logger.Fields{Zone: domain, IP: ip}, "transfer refused and %s", err)
+			return "refused-and-soa-failed"
+		}
+		return "refused-but-soa-ok"
+	case xerr.Timeout:
+		return "no-response"
+	case xerr.Truncated:
+		return "truncated"
+	}
+	return ""
+}
+
+// isHardNetError returns true if err shows the server can not be reached or will not send the zone, so retrying is pointless
+// timeouts and other errors are treated as transient
+func isHardNetError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	// servers that do not allow transfers often reset or close the connection instead of answering
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF)
+}
+
+// axfrWorker iterate through all possabilities and queries attempting an AXFR
+func (s *Scanner) axfrWorker(ctx context.Context, t target) error {
+	z := t.z
+	ips := make(map[string]bool)
+	domain := dns.Fqdn(t.domain)
+	if s.opts.Exclude.domain(domain) {
+		s.log.Debug(logger.Fields{Zone: domain}, "excluded, skipping")
+		atomic.AddUint32(&s.totalExcludedZones, 1)
+		return nil
+	}
+	s.results.attempt(domain)
+	s.countGlue(z, domain)
+	if t.resolve {
+		s.resolveNameservers(&z, domain)
+	}
+	if s.opts.Compare {
+		defer s.compareRecordSets(domain)
+	}
+	var err error
+	var records int64
+	if s.opts.Serials {
+		defer func() {
+			if records > 0 {
+				s.checkSerials(ctx, z, domain)
+			}
+		}()
+	}
+	// newIP returns true the first time ip is seen unless MaxNSIPs have already been tried
+	capped := false
+	newIP := func(ip net.IP) bool {
+		key := string(ip.To16())
+		if ips[key] {
+			return false
+		}
+		if s.opts.MaxNSIPs > 0 && len(ips) >= s.opts.MaxNSIPs {
+			if !capped {
+				s.log.Debug(logger.Fields{Zone: domain}, "tried the maximum of %d nameserver IPs, skipping the rest", s.opts.MaxNSIPs)
+				capped = true
+			}
+			return false
+		}
+		ips[key] = true
+		return true
+	}
+	// nameserver IPs to race when RaceNS is set
+	var race []raceTarget
+	for _, nameserver := range z.NS[domain] {
+		for _, ip := range z.IP[nameserver] {
+			if !s.IPAllowed(ip) {
+				continue
+			}
+			if newIP(ip) {
+				if s.opts.RaceNS {
+					race = append(race, raceTarget{nameserver: nameserver, ip: ip})
+					continue
+				}
+				records, err = s.axfrRetry(ctx, domain, nameserver, ip, nil)
+				if !s.opts.SaveAll && records != 0 {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if len(race) > 0 {
+		records, err = s.raceAXFR(ctx, domain, race)
+		if records != 0 || err != nil {
+			return err
+		}
+		race = nil
+	}
+	// there is no need to look up more nameservers once MaxNSIPs have been tried
+	if s.opts.QueryNameservers && (s.opts.MaxNSIPs == 0 || len(ips) < s.opts.MaxNSIPs) {
+		// query NS and run axfr on missing IPs
+		var qNameservers []string
+		for try := 0; try < s.opts.Retry; try++ {
+			qNameservers, err = s.LookupNS(domain)
+			if err != nil {
+				s.log.Debug(logger.Fields{Zone: domain}, "%s", err)
+				if errors.Is(err, errNXDomain) {
+					break
+				}
+			} else {
+				break
+			}
+			time.Sleep(1 * time.Second)
+		}
+		if s.opts.ParentNS {
+			// the parent's delegation can list nameservers the zone does not
+			for _, nameserver := range s.checkDelegation(domain, qNameservers) {
+				if !slices.Contains(qNameservers, nameserver) {
+					s.log.Debug(logger.Fields{Zone: domain, Nameserver: nameserver}, "adding delegation nameserver")
+					qNameservers = append(qNameservers, nameserver)
+				}
+			}
+		}
+		// the primary master in the SOA is often not a listed nameserver and is the most likely to allow transfers
+		mname, mErr := s.queryMNAME(s.opts.Nameserver, domain)
+		if mErr != nil {
+			s.log.Debug(logger.Fields{Zone: domain}, "%s", mErr)
+		} else if len(mname) > 0 && !slices.Contains(qNameservers, mname) {
+			s.log.Debug(logger.Fields{Zone: domain, Nameserver: mname}, "adding SOA MNAME")
+			qNameservers = append(qNameservers, mname)
+		}
+
+		for _, nameserver := range qNameservers {
+			var qIPs []net.IP
+			for try := 0; try < s.opts.Retry; try++ {
+				qIPs, err = s.LookupIP(nameserver)
+				if err != nil {
+					s.log.Debug(logger.Fields{Zone: domain}, "%s", err)
+					if errors.Is(err, errNXDomain) {
+						break
+					}
+				} else {
+					break
+				}
+				time.Sleep(1 * time.Second)
+			}
+
+			for _, ip := range qIPs {
+				if !s.IPAllowed(ip) {
+					continue
+				}
+				if newIP(ip) {
+					if s.opts.RaceNS {
+						race = append(race, raceTarget{nameserver: nameserver, ip: ip})
+						continue
+					}
+					records, err = s.axfrRetry(ctx, domain, nameserver, ip, nil)
+					if !s.opts.SaveAll && records != 0 {
+						return nil
+					}
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if len(race) > 0 {
+			records, err = s.raceAXFR(ctx, domain, race)
+			return err
+		}
+	}
+	return nil
+}
+
+// countGlue counts the nameservers of domain that have addresses in z and those that must be resolved
+func (s *Scanner) countGlue(z zone.Zone, domain string) {
+	glue := false
+	for _, nameserver := range z.NS[domain] {
+		if len(z.IP[nameserver]) > 0 {
+			glue = true
+			atomic.AddUint32(&s.totalGlue, 1)
+		} else {
+			atomic.AddUint32(&s.totalMissingGlue, 1)
+		}
+	}
+	if !glue && len(z.NS[domain]) > 0 {
+		atomic.AddUint32(&s.totalZonesWithoutGlue, 1)
+	}
+}
+
+// axfrRetry attempts an AXFR of domain from a single nameserver IP up to Retry times
+// claim is set when racing other nameserver IPs for the zone
+func (s *Scanner) axfrRetry(ctx context.Context, domain, nameserver string, ip net.IP, claim *raceClaim) (int64, error) {
+	if s.opts.Exclude.ip(ip) {
+		s.log.Debug(logger.Fields{Zone: domain, Nameserver: nameserver, IP: ip}, "excluded, skipping")
+		atomic.AddUint32(&s.totalExcludedIPs, 1)
+		return 0, nil
+	}
+	if !s.opts.AllowPrivate && privateIP(ip) {
+		s.log.Info(logger.Fields{Zone: domain, Nameserver: nameserver, IP: ip}, "private or reserved address, skipping")
+		atomic.AddUint32(&s.totalPrivateIPs, 1)
+		return 0, nil
+	}
+	var err error
+	var xerr *XfrError
+	var records int64
+	// racing transfers can not be retried once they claim the zone so they keep incomplete transfers straight away
+	keepIncomplete := claim != nil
+	for try := 0; try < s.opts.Retry; try++ {
+		release, lerr := s.ipLimiter.acquire(ctx, ip)
+		if lerr != nil {
+			break
+		}
+		s.log.Trace(logger.Fields{Zone: domain, Nameserver: nameserver, IP: ip}, "trying AXFR")
+		records, err = s.axfr(ctx, domain, nameserver, ip, claim, keepIncomplete)
+		release()
+		if err != nil {
+			s.log.Debug(logger.Fields{Zone: domain}, "%s", err)
+			remote := errors.As(err, &xerr)
+			if remote && xerr.Truncated && !keepIncomplete {
+				// servers often close transfers part way when rate limiting, so a truncated transfer is tried
+				// once more without counting against Retry and kept as incomplete if it is truncated again
+				// it is only a failure if the retry fails as well
+				s.log.Info(logger.Fields{Zone: domain, Nameserver: nameserver, IP: ip}, "transfer truncated, retrying in %s", truncatedRetryDelay)
+				keepIncomplete = true
+				try--
+				if sleep(ctx, truncatedRetryDelay) == nil {
+					err = nil
+					continue
+				}
+				// canceled before the retry so the truncated attempt is the failure
+			}
+			reason := err
+			if remote {
+				if class := s.failureClass(domain, ip, xerr); len(class) > 0 {
+					reason = fmt.Errorf("%s: %w", class, err)
+				}
+			}
+			s.results.fail(domain, nameserver, ip, reason)
+			if remote {
+				// remote errors are only retried
+				err = nil
+				if xerr.Permanent {
+					break
+				}
+			}
+		} else {
+			if records != 0 {
+				break
+			}
+		}
+		if sleep(ctx, 1*time.Second) != nil {
+			break
+		}
+	}
+	if s.opts.DryRun {
+		result := ProbeAllowed
+		var rcode string
+		if records <= 0 {
+			result = ProbeError
+			if xerr != nil && xerr.Refused {
+				result = ProbeRefused
+				rcode = xerr.RcodeString()
+			} else if xerr != nil && xerr.Timeout {
+				result = ProbeTimeout
+			}
+		}
+		s.results.probe(domain, nameserver, ip, result, rcode, records, s.version(ip))
+	}
+	return records, err
+}
+
+// sleep waits for d or until ctx is done, returning the context's error if it finished first
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (s *Scanner) axfr(ctx context.Context, domain, nameserver string, ip net.IP, claim *raceClaim, keepIncomplete bool) (int64, error) {
+	startTime := time.Now()
+	records, err := s.axfrToFile(ctx, domain, ip, nameserver, claim, keepIncomplete)
+	if err == nil && records > 0 {
+		took := time.Since(startTime).Round(time.Millisecond)
+		s.log.Info(logger.Fields{Zone: domain, Nameserver: nameserver, IP: ip, Records: records}, "xfr size: %d records in %s", records, took.String())
+		atomic.AddUint32(&s.totalXFR, 1)
+		t := s.results.transfer(domain, nameserver, ip, records, s.version(ip))
+		if s.opts.OnTransfer != nil {
+			s.opts.OnTransfer(t)
+		}
+	}
+	return records, err
+}
+
+// ixfrBaseSerial is the serial IXFR requests the changes since, 0 asks for the full history the server has
+const ixfrBaseSerial = 0
+
+// truncatedRetryDelay is the wait before retrying a transfer the server closed part way
+const truncatedRetryDelay = 5 * time.Second
+
+// envelopeOverhead is the size of the TCP length prefix and header of each transfer message
+const envelopeOverhead = 2 + 12
+
+// returns -1 if the sink skipped the zone, such as when it already exists and we are not overwriting,
+// or if claim is set and another nameserver IP sent records first
+// failures caused by the remote server are returned as an *XfrError
+// transfers that do not end with the starting SOA are saved as incomplete if keepIncomplete is set,
+// otherwise they are discarded and returned as a truncated *XfrError
+// a zone that can not be saved, such as when its upload fails, is also returned as an *XfrError so it is retried
+func (s *Scanner) axfrToFile(ctx context.Context, zone string, ip net.IP, nameserver string, claim *raceClaim, keepIncomplete bool) (records int64, err error) {
+	zone = dns.Fqdn(zone)
+
+	m := new(dns.Msg)
+	if s.opts.IXFR {
+		m.SetIxfr(zone, ixfrBaseSerial, "", "")
+	} else {
+		m.SetQuestion(zone, dns.TypeAXFR)
+	}
+
+	addr := net.JoinHostPort(ip.String(), s.port)
+	conn, err := s.dialTransfer(ctx, addr)
+	if err != nil {
+		return 0, newXfrError(zone, ip, err)
+	}
+	// closing the connection when the context is done interrupts any blocked read or write
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	// the bytes read are compared to the uncompressed size of the records to detect name compression
+	wire := &countingConn{Conn: conn}
+	env, err := transferIn(&dns.Conn{Conn: wire}, m, s.opts.Timeout)
+	if err != nil {
+		conn.Close()
+		return 0, newXfrError(zone, ip, err)
+	}
+	defer func() {
+		// stop the transfer if returning early and let it finish sending its result
+		conn.Close()
+		go func() {
+			for range env {
+			}
+		}()
+	}()
+
+	if s.opts.DryRun {
+		return dryRunEnvelope(zone, ip, env)
+	}
+	if claim != nil {
+		// only the first nameserver IP to send records saves the zone
+		first, ok := <-env
+		if !ok {
+			return 0, nil
+		}
+		// racers that fail or send nothing never open a sink, as every racer saves to the same file
+		if first.Error != nil {
+			return 0, newXfrError(zone, ip, first.Error)
+		}
+		if len(first.RR) == 0 {
+			return 0, nil
+		}
+		if !claim.take() {
+			s.log.Debug(logger.Fields{Zone: zone, Nameserver: nameserver, IP: ip}, "another nameserver is already transferring the zone")
+			return -1, nil
+		}
+		env = prependEnvelope(first, env)
+	}
+
+	zonefile, err := s.Sink(zone, nameserver, ip)
+	if err != nil {
+		return 0, err
+	}
+	if zonefile == nil {
+		return -1, nil
+	}
+	var envelope, outOfZone int64
+	defer func() {
+		if outOfZone > 0 {
+			s.log.Warn(logger.Fields{Zone: zone, Nameserver: nameserver, IP: ip}, "%d out of bailiwick records", outOfZone)
+		}
+		ferr := finishZone(zonefile, envelope, outOfZone)
+		if ferr != nil && err == nil {
+			s.log.Warn(logger.Fields{Zone: zone, Nameserver: nameserver, IP: ip}, "unable to save zone: %s", ferr)
+			// the zone was not saved so the transfer is a failure that can be retried
+			_ = zonefile.Abort()
+			records, err = 0, &XfrError{err: fmt.Errorf("unable to save zone: %s from ip: %s: %w", zone, ip.String(), ferr)}
+		}
+	}()
+	err = zonefile.WriteComment("Generated by ALLXFR (https://github.com/lanrat/allxfr)\n")
+	if err != nil {
+		return zonefile.Records(), err
+	}
+	err = zonefile.WriteCommentKey("nameserver", nameserver)
+	if err != nil {
+		return zonefile.Records(), err
+	}
+	err = zonefile.WriteCommentKey("nameserverIP", ip.String())
+	if err != nil {
+		return zonefile.Records(), err
+	}
+	axfrType := "AXFR"
+	if s.opts.IXFR {
+		axfrType = "IXFR"
+	}
+	err = zonefile.WriteCommentKey("xfr", axfrType)
+	if err != nil {
+		return zonefile.Records(), err
+	}
+	if s.opts.IXFR {
+		err = zonefile.WriteCommentKey("ixfr_base_serial", fmt.Sprintf("%d", ixfrBaseSerial))
+		if err != nil {
+			return zonefile.Records(), err
+		}
+	}
+	if s.opts.NSVersion {
+		if version := s.nsVersion(ip); len(version) > 0 {
+			err = zonefile.WriteCommentKey("ns_version", version)
+			if err != nil {
+				return zonefile.Records(), err
+			}
+		}
+	}
+
+	var firstSOA *dns.SOA
+	var lastRR dns.RR
+	var size int64
+	// all records are kept for Compare
+	var received []dns.RR
+	types := make(map[uint16]uint64)
+	// wildcard owner names in the zone
+	wildcards := make(map[string]bool)
+	// delegations and glue in the zone for SubzoneDepth
+	found := s.subzones.collector(zone)
+	for e := range env {
+		if e.Error != nil {
+			if ctx.Err() != nil {
+				// canceled, do not keep the partial zone
+				s.log.Debug(logger.Fields{Zone: zone}, "transfer canceled: %s", ctx.Err())
+				return 0, s.abort(zonefile, envelope, ctx.Err())
+			}
+			xerr := newXfrError(zone, ip, e.Error)
+			xerr.err = fmt.Errorf("transfer envelope error from zone: %s ip: %s (rec: %d, envelope: %d): %w", zone, ip.String(), zonefile.Records(), envelope, e.Error)
+			if zonefile.Records() == 0 {
+				return 0, xerr
+			}
+			// keep the records received so far
+			s.log.Debug(logger.Fields{Zone: zone}, "%s", xerr)
+			break
+		}
+		for _, rr := range e.RR {
+			// the transfer must start with the SOA of the requested zone, even if it sent empty envelopes first
+			if lastRR == nil {
+				soa, ok := rr.(*dns.SOA)
+				if !ok || !strings.EqualFold(soa.Hdr.Name, zone) {
+					s.log.Warn(logger.Fields{Zone: zone, Nameserver: nameserver, IP: ip}, "transfer does not start with SOA for zone, got: %s", rr.String())
+					err = zonefile.Abort()
+					if err != nil {
+						return 0, err
+					}
+					return 0, &XfrError{Permanent: true, err: fmt.Errorf("transfer from zone: %s ip: %s does not start with SOA for zone, got: %s", zone, ip.String(), rr.String())}
+				}
+				firstSOA = soa
+			}
+			if !dns.IsSubDomain(zone, rr.Header().Name) {
+				outOfZone++
+			}
+			size += int64(dns.Len(rr))
+			if (s.opts.MaxRecords > 0 && zonefile.Records() >= s.opts.MaxRecords) || (s.opts.MaxSize > 0 && size > s.opts.MaxSize) {
+				s.log.Warn(logger.Fields{Zone: zone, Nameserver: nameserver, IP: ip, Records: zonefile.Records()}, "transfer exceeded the record or size limit after %d records and %d bytes, aborting", zonefile.Records(), size)
+				limitErr := fmt.Errorf("transfer from zone: %s ip: %s exceeded limit after %d records and %d bytes", zone, ip.String(), zonefile.Records(), size)
+				err = s.abort(zonefile, envelope, limitErr)
+				if err != nil {
+					return 0, err
+				}
+				return 0, &XfrError{Permanent: true, err: limitErr}
+			}
+			// create file here on first iteration of loop
+			err := zonefile.AddRR(rr)
+			if err != nil {
+				return zonefile.Records(), err
+			}
+			lastRR = rr
+			types[rr.Header().Rrtype]++
+			if strings.HasPrefix(rr.Header().Name, "*.") {
+				wildcards[strings.ToLower(rr.Header().Name)] = true
+			}
+			s.onRecord(ctx, zone, rr)
+			if found != nil {
+				discoverSubzone(found, zone, rr)
+			}
+			if s.opts.Compare {
+				received = append(received, rr)
+			}
+		}
+		envelope++
+	}
+
+	if !keepIncomplete && zonefile.Records() > 0 && !transferComplete(firstSOA, lastRR) {
+		truncErr := fmt.Errorf("transfer from zone: %s ip: %s truncated after %d records", zone, ip.String(), zonefile.Records())
+		// the retry may fail without sending anything, so KeepPartial keeps these records until then
+		err = s.abort(zonefile, envelope, truncErr)
+		if err != nil {
+			return 0, err
+		}
+		return 0, &XfrError{Truncated: true, err: truncErr}
+	}
+	s.results.countTypes(types)
+	if found != nil {
+		s.addSubzones(zone, *found)
+	}
+	if len(wildcards) > 0 {
+		s.results.addWildcards(zone, len(wildcards))
+		err = zonefile.WriteCommentKey("wildcards", fmt.Sprintf("%d", len(wildcards)))
+		if err != nil {
+			return zonefile.Records(), err
+		}
+	}
+	if zonefile.Records() > 0 {
+		err = s.writeCompression(zonefile, zone, wire.read.Load(), size+envelope*envelopeOverhead)
+		if err != nil {
+			return zonefile.Records(), err
+		}
+	}
+	if zonefile.Records() > 0 {
+		// the serial of the zone that was received, the newest serial for IXFR
+		serial := "none"
+		if firstSOA != nil {
+			serial = fmt.Sprintf("%d", firstSOA.Serial)
+		}
+		err = zonefile.WriteCommentKey("serial", serial)
+		if err != nil {
+			return zonefile.Records(), err
+		}
+	}
+	if zonefile.Records() > 0 && !transferComplete(firstSOA, lastRR) {
+		s.log.Warn(logger.Fields{Zone: zone, Nameserver: nameserver, IP: ip, Records: zonefile.Records()}, "incomplete transfer, did not end with the starting SOA")
+		err = zonefile.WriteCommentKey("incomplete", "true")
+		if err != nil {
+			return zonefile.Records(), err
+		}
+	} else if s.opts.Compare && zonefile.Records() > 0 {
+		// incomplete transfers would always differ so they are not compared
+		s.results.addRecordSet(zone, nameserver, ip, save.CanonicalRecords(received))
+	}
+
+	return zonefile.Records(), err
+}
+
+// writeCompression saves the bytes received for a transfer and the size of its messages without name compression
+// the question is not counted as servers may leave it out after the first message, so fewer bytes received than the
+// uncompressed size means the server compressed names
+func (s *Scanner) writeCompression(zonefile save.Sink, zone string, wire, uncompressed int64) error {
+	ratio := float64(wire) / float64(uncompressed)
+	s.log.Debug(logger.Fields{Zone: zone}, "received %d bytes for %d bytes uncompressed, ratio %.3f", wire, uncompressed, ratio)
+	err := zonefile.WriteCommentKey("wire_bytes", fmt.Sprintf("%d", wire))
+	if err != nil {
+		return err
+	}
+	err = zonefile.WriteCommentKey("uncompressed_bytes", fmt.Sprintf("%d", uncompressed))
+	if err != nil {
+		return err
+	}
+	err = zonefile.WriteCommentKey("compression_ratio", fmt.Sprintf("%.3f", ratio))
+	if err != nil {
+		return err
+	}
+	return zonefile.WriteCommentKey("compressed", fmt.Sprintf("%t", wire < uncompressed))
+}
+
+// finishZone adds the closing comments to zonefile and finishes it, doing nothing if it was already aborted
+func finishZone(zonefile save.Sink, envelopes, outOfZone int64) error {
+	if outOfZone > 0 {
+		err := zonefile.WriteCommentKey("out_of_bailiwick", fmt.Sprintf("%d", outOfZone))
+		if errors.Is(err, save.ErrFileClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err := zonefile.WriteCommentKey("envelopes", fmt.Sprintf("%d", envelopes))
+	if errors.Is(err, save.ErrFileClosed) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return zonefile.Finish()
+}
+
+// abort discards a zone that failed part way, or keeps the records received so far with KeepPartial
+func (s *Scanner) abort(zonefile save.Sink, envelopes int64, reason error) error {
+	partial, ok := zonefile.(save.PartialSink)
+	if !s.opts.KeepPartial || !ok || zonefile.Records() == 0 {
+		return zonefile.Abort()
+	}
+	err := zonefile.WriteCommentKey("envelopes", fmt.Sprintf("%d", envelopes))
+	if err != nil {
+		return err
+	}
+	return partial.KeepPartial(reason.Error())
+}
+
+// Sink returns the sink for a transfer of zone from ip using NewSink, or zone files in SaveDir if not set
+// a nil Sink means the transfer should be skipped
+func (s *Scanner) Sink(zone, nameserver string, ip net.IP) (save.Sink, error) {
+	if s.opts.NewSink != nil {
+		return s.opts.NewSink(zone, nameserver, ip)
+	}
+	return s.fileSink(zone, nameserver, ip)
+}
+
+// fileSink returns the zone file in SaveDir for a transfer of zone from ip
+// or nil if the zone already exists and is not being overwritten or diffed
+func (s *Scanner) fileSink(zone, nameserver string, ip net.IP) (save.Sink, error) {
+	filename := path.Join(s.saveDir(zone), s.ZonePath(zone, nameserver, ip))
+	dir := path.Dir(filename)
+	var diffBase string
+	if s.opts.Diff {
+		if _, err := os.Stat(filename); err == nil {
+			// save the changes since the existing zone next to it instead
+			diffBase = filename
+			ext := ""
+			if !s.opts.Uncompressed {
+				ext = ".gz"
+			}
+			filename = strings.TrimSuffix(filename, "zone"+ext) + "diff" + ext
+		}
+	}
+	if !s.opts.Overwrite && len(diffBase) == 0 {
+		if _, err := os.Stat(filename); err == nil || !os.IsNotExist(err) {
+			s.log.Debug(logger.Fields{Zone: zone}, "file %q exists, skipping", filename)
+			return nil, nil
+		}
+	}
+	// the temporary file is in the same directory so it can be renamed into place
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	s.log.Debug(logger.Fields{}, "saving zone %q to file %s", zone, filename)
+	return save.New(zone, filename, save.Options{Sort: s.opts.Sort, Meta: s.opts.Meta, GzipLevel: s.opts.GzipLevel, Uncompressed: s.opts.Uncompressed, DiffBase: diffBase, FileLimit: s.fileLimit}), nil
+}
+
+// saveDir returns the directory zone is saved in, its shard of SaveDirs if set
+func (s *Scanner) saveDir(zone string) string {
+	if len(s.opts.SaveDirs) == 0 {
+		return s.opts.SaveDir
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(dns.Fqdn(zone))))
+	return s.opts.SaveDirs[h.Sum32()%uint32(len(s.opts.SaveDirs))]
+}
+
+// ZonePath returns the path relative to SaveDir that a transfer of zone from ip is saved to according to the Options
+func (s *Scanner) ZonePath(zone, nameserver string, ip net.IP) string {
+	zone = dns.Fqdn(zone)
+	ext := ".gz"
+	if s.opts.Uncompressed {
+		ext = ""
+	}
+	dir := layoutDir(s.opts.Layout, zone)
+	name := zone
+	if zone == "." {
+		// the root zone would otherwise be a hidden file
+		name = "root."
+	}
+	if s.opts.SaveAll {
+		return path.Join(dir, shortenFilename(fmt.Sprintf("%s_%s_%s", name, nameserver, ip.String()), "_zone"+ext))
+	}
+	return path.Join(dir, shortenFilename(name[:len(name)-1], ".zone"+ext))
+}
+
+// transferComplete returns true if the last record of a transfer is the same SOA it started with
+func transferComplete(first *dns.SOA, last dns.RR) bool {
+	soa, ok := last.(*dns.SOA)
+	return ok && first != nil && strings.EqualFold(soa.Hdr.Name, first.Hdr.Name) && soa.Serial == first.Serial
+}
+
+// dryRunEnvelope returns the number of records in the first non-empty envelope of a transfer without saving anything
+func dryRunEnvelope(zone string, ip net.IP, env chan *dns.Envelope) (int64, error) {
+	for e := range env {
+		if e.Error != nil {
+			return 0, newXfrError(zone, ip, e.Error)
+		}
+		if len(e.RR) > 0 {
+			return int64(len(e.RR)), nil
+		}
+	}
+	return 0, nil
+}
+
+// dialTransfer opens the TCP connection used for a zone transfer, applying BandwidthLimit if set
+// reads only time out after Timeout passes without receiving any data, including while waiting for BandwidthLimit
+func (s *Scanner) dialTransfer(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: s.opts.Timeout}
+	if s.opts.SourceIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: s.opts.SourceIP}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.bwLimiter != nil {
+		conn = &rateLimitedConn{Conn: conn, ctx: ctx, limiter: s.bwLimiter}
+	}
+	return &progressConn{Conn: conn, timeout: s.opts.Timeout}, nil
+}
+
+// layouts of the zone files in SaveDir
+const (
+	// LayoutFlat saves every zone directly in SaveDir
+	LayoutFlat = "flat"
+	// LayoutTLD saves zones in a directory named after their TLD
+	LayoutTLD = "tld"
+	// LayoutHashed saves zones in one of 256 directories named after the start of a hash of the zone
+	LayoutHashed = "hashed"
+)
+
+// layoutDir returns the directory under SaveDir that zone is saved in for layout
+func layoutDir(layout, zone string) string {
+	switch layout {
+	case LayoutTLD:
+		labels := dns.SplitDomainName(strings.ToLower(zone))
+		if len(labels) == 0 {
+			return "root"
+		}
+		return labels[len(labels)-1]
+	case LayoutHashed:
+		sum := sha256.Sum256([]byte(strings.ToLower(zone)))
+		return hex.EncodeToString(sum[:1])
+	}
+	return ""
+}
+
+// maxFilenameLen is the longest file name allowed by most filesystems
+const maxFilenameLen = 255
+
+// shortenFilename returns name with suffix appended, if the result and its temporary file would be too long
+// the end of name is replaced with a hash of the full name so that the file name stays unique
+func shortenFilename(name, suffix string) string {
+	const tmpSuffix = ".tmp"
+	if len(name)+len(suffix)+len(tmpSuffix) <= maxFilenameLen {
+		return name + suffix
+	}
+	sum := sha256.Sum256([]byte(name))
+	hash := hex.EncodeToString(sum[:8])
+	keep := maxFilenameLen - len(tmpSuffix) - len(suffix) - len(hash) - 1
+	return fmt.Sprintf("%s_%s%s", name[:keep], hash, suffix)
+}
@@ -0,0 +1,195 @@
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/lanrat/allxfr/zone"
+
+	"github.com/miekg/dns"
+)
+
+// errTimeout is a read that timed out
+var errTimeout = &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+
+func TestNewXfrError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		refused   bool
+		rcode     string
+		timeout   bool
+		permanent bool
+	}{
+		{name: "refused", err: rcodeError(dns.RcodeRefused), refused: true, rcode: "REFUSED", permanent: true},
+		{name: "not auth", err: rcodeError(dns.RcodeNotAuth), refused: true, rcode: "NOTAUTH", permanent: true},
+		{name: "unknown rcode", err: rcodeError(4000), refused: true, rcode: "RCODE4000", permanent: true},
+		{name: "wrapped rcode", err: fmt.Errorf("first reply: %w", rcodeError(dns.RcodeServerFailure)), refused: true, rcode: "SERVFAIL", permanent: true},
+		{name: "timeout", err: errTimeout, timeout: true},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, permanent: true},
+		{name: "connection reset", err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, permanent: true},
+		{name: "closed", err: io.EOF, permanent: true},
+		{name: "no soa", err: dns.ErrSoa, permanent: true},
+		{name: "other", err: errors.New("bad message")},
+	}
+	ip := net.ParseIP("192.0.2.1")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			xerr := newXfrError("example.com.", ip, test.err)
+			if xerr.Refused != test.refused || xerr.RcodeString() != test.rcode || xerr.Timeout != test.timeout || xerr.Permanent != test.permanent {
+				t.Errorf("got refused %t rcode %q timeout %t permanent %t, want %t %q %t %t",
+					xerr.Refused, xerr.RcodeString(), xerr.Timeout, xerr.Permanent, test.refused, test.rcode, test.timeout, test.permanent)
+			}
+			if xerr.Truncated {
+				t.Error("got truncated, want not truncated")
+			}
+			if !errors.Is(xerr, test.err) {
+				t.Errorf("error %q does not wrap %q", xerr, test.err)
+			}
+		})
+	}
+}
+
+func TestFailureClass(t *testing.T) {
+	port := startServer(t, testHandler(), "127.0.0.1")
+	s := newTestScanner(t, Options{}, port)
+	ip := net.ParseIP("127.0.0.1")
+	tests := []struct {
+		name string
+		zone string
+		xerr *XfrError
+		want string
+	}{
+		// the test server answers the SOA of refused.example. but not unknown.example.
+		{name: "refused soa ok", zone: "refused.example.", xerr: newXfrError("refused.example.", ip, rcodeError(dns.RcodeRefused)), want: "refused-but-soa-ok"},
+		{name: "refused soa failed", zone: "unknown.example.", xerr: newXfrError("unknown.example.", ip, rcodeError(dns.RcodeNotAuth)), want: "refused-and-soa-failed"},
+		{name: "timeout", zone: "example.com.", xerr: newXfrError("example.com.", ip, errTimeout), want: "no-response"},
+		{name: "truncated", zone: "example.com.", xerr: &XfrError{Truncated: true, err: errors.New("truncated")}, want: "truncated"},
+		{name: "network error", zone: "example.com.", xerr: newXfrError("example.com.", ip, io.EOF), want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := s.failureClass(test.zone, ip, test.xerr)
+			if got != test.want {
+				t.Errorf("got class %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAxfrToFileTruncated(t *testing.T) {
+	port := startServer(t, testHandler(), "127.0.0.1")
+	sent := int64(len(testRecords) - 1)
+	ip := net.ParseIP("127.0.0.1")
+
+	t.Run("discarded", func(t *testing.T) {
+		dir := t.TempDir()
+		s := newTestScanner(t, Options{SaveDir: dir}, port)
+		records, err := s.axfrToFile(context.Background(), "truncated.example.", ip, "ns1.example.com.", nil, false)
+		var xerr *XfrError
+		if !errors.As(err, &xerr) || !xerr.Truncated {
+			t.Fatalf("got %d records and error %v, want a truncated XfrError", records, err)
+		}
+		if records != 0 {
+			t.Errorf("got %d records, want 0", records)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("truncated transfer saved files %v", entries)
+		}
+	})
+
+	t.Run("kept partial", func(t *testing.T) {
+		dir := t.TempDir()
+		s := newTestScanner(t, Options{SaveDir: dir, KeepPartial: true}, port)
+		_, err := s.axfrToFile(context.Background(), "truncated.example.", ip, "ns1.example.com.", nil, false)
+		var xerr *XfrError
+		if !errors.As(err, &xerr) || !xerr.Truncated {
+			t.Fatalf("got error %v, want a truncated XfrError", err)
+		}
+		filename := path.Join(dir, "truncated.example.partial.zone")
+		keys, err := zone.ReadCommentKeys(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys["error"]) == 0 || keys["envelopes"] != "2" || keys["records"] != fmt.Sprintf("%d", sent) {
+			t.Errorf("got keys %v, want the error, 2 envelopes and %d records", keys, sent)
+		}
+		if _, err := os.Stat(path.Join(dir, "truncated.example.zone")); !os.IsNotExist(err) {
+			t.Errorf("truncated transfer saved as a complete zone: %v", err)
+		}
+	})
+
+	t.Run("kept incomplete", func(t *testing.T) {
+		dir := t.TempDir()
+		s := newTestScanner(t, Options{SaveDir: dir}, port)
+		records, err := s.axfrToFile(context.Background(), "truncated.example.", ip, "ns1.example.com.", nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if records != sent {
+			t.Errorf("got %d records, want %d", records, sent)
+		}
+		filename := path.Join(dir, "truncated.example.zone")
+		keys, err := zone.ReadCommentKeys(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keys["incomplete"] != "true" {
+			t.Errorf("truncated transfer saved without the incomplete key, got keys %v", keys)
+		}
+		rrs, err := zone.ReadRecords(filename, "truncated.example.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(rrs)) != sent {
+			t.Errorf("saved %d records, want %d", len(rrs), sent)
+		}
+	})
+}
+
+func TestAxfrToFileBadStart(t *testing.T) {
+	mux := testHandler()
+	// the records of example.com. as if they were the zone
+	mux.HandleFunc("wrong.example.", func(w dns.ResponseWriter, r *dns.Msg) {
+		serveTestZone(w, r, mustRRs(testRecords))
+	})
+	// an empty message before the records of the zone
+	mux.HandleFunc("empty.example.", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		w.WriteMsg(m)
+		m.Answer = renameRRs(mustRRs(testRecords), "empty.example.")
+		w.WriteMsg(m)
+	})
+	port := startServer(t, mux, "127.0.0.1")
+	ip := net.ParseIP("127.0.0.1")
+	for _, name := range []string{"wrong.example.", "empty.example."} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := newTestScanner(t, Options{SaveDir: dir}, port)
+			records, err := s.axfrToFile(context.Background(), name, ip, "ns1.example.com.", nil, false)
+			var xerr *XfrError
+			if !errors.As(err, &xerr) || !xerr.Permanent || records != 0 {
+				t.Fatalf("got %d records and error %v, want a permanent XfrError", records, err)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("transfer saved files %v", entries)
+			}
+		})
+	}
+}
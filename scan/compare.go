@@ -0,0 +1,110 @@
+package scan
+
+import (
+	"net"
+
+	"github.com/lanrat/allxfr/logger"
+	"github.com/lanrat/allxfr/save"
+)
+
+// RecordSet is the canonical record set of a zone as transferred from a single nameserver IP
+type RecordSet struct {
+	Nameserver string `json:"nameserver"`
+	IP         string `json:"ip"`
+	SHA256     string `json:"sha256"`
+	Records    int    `json:"records"`
+	// records not returned by the first server
+	Added []string `json:"added,omitempty"`
+	// records returned by the first server but not this one
+	Removed []string `json:"removed,omitempty"`
+	records []string
+}
+
+// ZoneMismatch is a zone whose nameservers returned different record sets
+type ZoneMismatch struct {
+	Zone    string      `json:"zone"`
+	Servers []RecordSet `json:"servers"`
+}
+
+// addRecordSet saves the record set of zone transferred from ip until compareRecordSets is called for the zone
+func (r *scanResults) addRecordSet(zone, nameserver string, ip net.IP, records []string) {
+	r.Lock()
+	defer r.Unlock()
+	r.recordSets[zone] = append(r.recordSets[zone], RecordSet{
+		Nameserver: nameserver,
+		IP:         ip.String(),
+		SHA256:     save.HashRecords(records),
+		Records:    len(records),
+		records:    records,
+	})
+}
+
+// compareRecordSets compares the record sets saved for zone against the first one and logs and records any mismatch
+// the saved record sets are released
+func (s *Scanner) compareRecordSets(zone string) {
+	sets := s.results.takeRecordSets(zone)
+	if len(sets) < 2 {
+		return
+	}
+	match := true
+	for _, set := range sets[1:] {
+		if set.SHA256 != sets[0].SHA256 {
+			match = false
+			break
+		}
+	}
+	if match {
+		s.log.Debug(logger.Fields{Zone: zone}, "%d nameservers returned identical records %s", len(sets), sets[0].SHA256)
+		return
+	}
+
+	first := make(map[string]bool, len(sets[0].records))
+	for _, record := range sets[0].records {
+		first[record] = true
+	}
+	s.log.Warn(logger.Fields{Zone: zone}, "nameservers returned different records")
+	for i := range sets {
+		set := &sets[i]
+		if i > 0 && set.SHA256 != sets[0].SHA256 {
+			own := make(map[string]bool, len(set.records))
+			for _, record := range set.records {
+				own[record] = true
+				if !first[record] {
+					set.Added = append(set.Added, record)
+				}
+			}
+			for _, record := range sets[0].records {
+				if !own[record] {
+					set.Removed = append(set.Removed, record)
+				}
+			}
+		}
+		s.log.Info(logger.Fields{Zone: zone, Nameserver: set.Nameserver, IP: net.ParseIP(set.IP), Records: int64(set.Records)}, "%d records sha256: %s added: %d removed: %d", set.Records, set.SHA256, len(set.Added), len(set.Removed))
+		for _, record := range set.Added {
+			s.log.Debug(logger.Fields{Zone: zone, Nameserver: set.Nameserver, IP: net.ParseIP(set.IP)}, "+ %s", record)
+		}
+		for _, record := range set.Removed {
+			s.log.Debug(logger.Fields{Zone: zone, Nameserver: set.Nameserver, IP: net.ParseIP(set.IP)}, "- %s", record)
+		}
+	}
+	for i := range sets {
+		sets[i].records = nil
+	}
+	s.results.mismatch(ZoneMismatch{Zone: zone, Servers: sets})
+}
+
+// takeRecordSets removes and returns the record sets saved for zone
+func (r *scanResults) takeRecordSets(zone string) []RecordSet {
+	r.Lock()
+	defer r.Unlock()
+	sets := r.recordSets[zone]
+	delete(r.recordSets, zone)
+	return sets
+}
+
+// mismatch records a zone whose nameservers returned different records
+func (r *scanResults) mismatch(m ZoneMismatch) {
+	r.Lock()
+	defer r.Unlock()
+	r.mismatches = append(r.mismatches, m)
+}
@@ -0,0 +1,60 @@
+package scan
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitedConn is a net.Conn whose reads are throttled by a limiter that may be shared between connections
+type rateLimitedConn struct {
+	net.Conn
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+// Read reads at most one burst worth of data from the connection and then waits until the limiter allows it
+func (c *rateLimitedConn) Read(p []byte) (int, error) {
+	if burst := c.limiter.Burst(); len(p) > burst {
+		p = p[:burst]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		if werr := c.limiter.WaitN(c.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// progressConn is a net.Conn whose read deadline is pushed back by timeout every time data is read
+// so that a large transfer that is slow but making progress is not timed out while a stalled one still is
+type progressConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// Read reads from the connection and extends the read deadline if anything was read
+func (c *progressConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && err == nil {
+		err = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	return n, err
+}
+
+// countingConn is a net.Conn that counts the bytes read from it
+type countingConn struct {
+	net.Conn
+	read atomic.Int64
+}
+
+// Read reads from the connection and adds the bytes read to the count
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,83 @@
+package scan
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// cookieUDPSize is the EDNS0 UDP payload size advertised in queries with cookies
+const cookieUDPSize = 1232
+
+// cookieJar holds the DNS cookies (RFC 7873) used with each server for Cookies
+type cookieJar struct {
+	// secret makes the client cookies unpredictable
+	secret []byte
+	mu     sync.Mutex
+	// map of server to the last server cookie it sent, hex encoded
+	servers map[string]string
+}
+
+func newCookieJar() *cookieJar {
+	secret := make([]byte, 16)
+	// crypto/rand does not fail on supported platforms
+	_, _ = rand.Read(secret)
+	return &cookieJar{
+		secret:  secret,
+		servers: make(map[string]string),
+	}
+}
+
+// clientCookie returns the hex encoded 8 byte client cookie used with server
+func (j *cookieJar) clientCookie(server string) string {
+	h := sha256.New()
+	h.Write(j.secret)
+	h.Write([]byte(server))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// add adds a COOKIE option to m with the client cookie for server and the server cookie if one is known
+func (j *cookieJar) add(m *dns.Msg, server string) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(cookieUDPSize, false)
+		opt = m.IsEdns0()
+	}
+	j.mu.Lock()
+	cookie := j.clientCookie(server) + j.servers[server]
+	j.mu.Unlock()
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0COOKIE {
+			options = append(options, o)
+		}
+	}
+	opt.Option = append(options, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+}
+
+// update saves the server cookie in a response from server if it echoes our client cookie
+func (j *cookieJar) update(server string, in *dns.Msg) {
+	opt := in.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, o := range opt.Option {
+		cookie, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		client := j.clientCookie(server)
+		// server cookies are 8 to 32 bytes after the 8 byte client cookie
+		if len(cookie.Cookie) < len(client)+16 || len(cookie.Cookie) > len(client)+64 || !strings.EqualFold(cookie.Cookie[:len(client)], client) {
+			return
+		}
+		j.mu.Lock()
+		j.servers[server] = cookie.Cookie[len(client):]
+		j.mu.Unlock()
+		return
+	}
+}
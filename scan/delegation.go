@@ -0,0 +1,139 @@
+package scan
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/lanrat/allxfr/logger"
+
+	"github.com/miekg/dns"
+)
+
+// DelegationMismatch is a zone whose nameservers in the referral from its parent differ from the nameservers it reports for ParentNS
+type DelegationMismatch struct {
+	Zone string `json:"zone"`
+	// Delegation is the nameservers in the referral from the parent zone
+	Delegation []string `json:"delegation"`
+	// Nameservers is the nameservers the zone itself reports
+	Nameservers []string `json:"nameservers"`
+}
+
+// addDelegationMismatch records a zone whose delegation differs from its own nameservers
+func (r *scanResults) addDelegationMismatch(mismatch DelegationMismatch) {
+	r.Lock()
+	defer r.Unlock()
+	r.delegations = append(r.delegations, mismatch)
+}
+
+// checkDelegation returns the nameservers of domain in the referral from its parent zone
+// and records them if they differ from the nameservers the zone reports
+func (s *Scanner) checkDelegation(domain string, nameservers []string) []string {
+	delegation, err := s.queryDelegation(domain)
+	if err != nil {
+		s.log.Debug(logger.Fields{Zone: domain}, "unable to query delegation: %s", err)
+		return nil
+	}
+	if len(nameservers) > 0 && !sameNameservers(delegation, nameservers) {
+		s.log.Info(logger.Fields{Zone: domain}, "delegation nameservers %v differ from zone nameservers %v", delegation, nameservers)
+		s.results.addDelegationMismatch(DelegationMismatch{
+			Zone:        domain,
+			Delegation:  sortedNames(delegation),
+			Nameservers: sortedNames(nameservers),
+		})
+	}
+	return delegation
+}
+
+// queryDelegation asks the nameservers of the closest parent zone of domain for its referral
+func (s *Scanner) queryDelegation(domain string) ([]string, error) {
+	domain = dns.Fqdn(domain)
+	if domain == "." {
+		return nil, errors.New("the root zone has no parent")
+	}
+	// the parent zone is the closest enclosing name with nameservers
+	var parentNS []string
+	parent := domain
+	for len(parentNS) == 0 && parent != "." {
+		i, _ := dns.NextLabel(parent, 0)
+		parent = parent[i:]
+		if len(parent) == 0 {
+			parent = "."
+		}
+		var err error
+		parentNS, err = s.LookupNS(parent)
+		if err != nil && !errors.Is(err, errNXDomain) {
+			return nil, err
+		}
+	}
+	var lastErr error
+	for _, nameserver := range parentNS {
+		ips, err := s.LookupIP(nameserver)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, ip := range ips {
+			if !s.IPAllowed(ip) || s.opts.Exclude.ip(ip) || (!s.opts.AllowPrivate && privateIP(ip)) {
+				continue
+			}
+			delegation, err := s.queryReferral(net.JoinHostPort(ip.String(), s.port), domain)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			return delegation, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no nameservers of parent zone %s to query", parent)
+	}
+	return nil, lastErr
+}
+
+// queryReferral returns the nameservers of domain in the answer or authority section from the parent zone's server
+func (s *Scanner) queryReferral(server, domain string) ([]string, error) {
+	s.log.Trace(logger.Fields{}, "dns query: @%s NS %s", server, domain)
+	m := new(dns.Msg)
+	m.SetQuestion(domain, dns.TypeNS)
+	m.RecursionDesired = false
+
+	in, err := s.exchange(m, server)
+	if err != nil {
+		return nil, err
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("NS %s: %s", domain, dns.RcodeToString[in.Rcode])
+	}
+
+	out := make([]string, 0, 2)
+	// a parent that is also authoritative for the zone answers instead of referring
+	for _, rr := range slices.Concat(in.Answer, in.Ns) {
+		if t, ok := rr.(*dns.NS); ok && strings.EqualFold(t.Hdr.Name, domain) {
+			s.log.Trace(logger.Fields{}, "dns referral NS @%s\t%s:\t%s\n", server, domain, t.Ns)
+			ns := strings.ToLower(t.Ns)
+			if !slices.Contains(out, ns) {
+				out = append(out, ns)
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("NS %s: no referral from %s", domain, server)
+	}
+	return out, nil
+}
+
+// sameNameservers returns true if a and b have the same nameservers in any order
+func sameNameservers(a, b []string) bool {
+	return slices.Equal(sortedNames(a), sortedNames(b))
+}
+
+// sortedNames returns a sorted copy of names without duplicates
+func sortedNames(names []string) []string {
+	out := slices.Clone(names)
+	sort.Strings(out)
+	return slices.Compact(out)
+}
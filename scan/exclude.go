@@ -0,0 +1,137 @@
+package scan
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ExcludeList holds the domains and networks that must never be transferred from
+type ExcludeList struct {
+	domains map[string]bool
+	nets    []*net.IPNet
+}
+
+// LoadExcludeList parses a file of domains, IPs and CIDRs, one per line
+// blank lines and lines starting with # are ignored
+func LoadExcludeList(filename string) (*ExcludeList, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	e := &ExcludeList{
+		domains: make(map[string]bool),
+	}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if len(entry) == 0 || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", filename, line, err)
+			}
+			e.nets = append(e.nets, ipNet)
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			e.nets = append(e.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		if _, ok := dns.IsDomainName(entry); !ok {
+			return nil, fmt.Errorf("%s:%d: invalid domain %q", filename, line, entry)
+		}
+		e.domains[dns.Fqdn(strings.ToLower(entry))] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// domain returns true if the domain or any of its parents are excluded
+func (e *ExcludeList) domain(domain string) bool {
+	if e == nil {
+		return false
+	}
+	domain = dns.Fqdn(strings.ToLower(domain))
+	for _, i := range dns.Split(domain) {
+		if e.domains[domain[i:]] {
+			return true
+		}
+	}
+	return false
+}
+
+// ip returns true if the IP is inside any excluded network
+func (e *ExcludeList) ip(ip net.IP) bool {
+	if e == nil {
+		return false
+	}
+	for _, ipNet := range e.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of excluded domains and networks
+func (e *ExcludeList) Len() (domains, nets int) {
+	if e == nil {
+		return 0, 0
+	}
+	return len(e.domains), len(e.nets)
+}
+
+// reservedNets are special purpose networks not covered by the net.IP classification methods that are never reachable
+// nameservers on the public internet
+var reservedNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"240.0.0.0/4",
+	"2001:db8::/32",
+)
+
+// privateIP returns true if ip is a private, loopback, link local or otherwise reserved address
+func privateIP(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return true
+	}
+	for _, ipNet := range reservedNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	out := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		out = append(out, ipNet)
+	}
+	return out
+}
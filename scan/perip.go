@@ -0,0 +1,44 @@
+package scan
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// ipLimiter limits the number of transfers in progress from each nameserver IP
+type ipLimiter struct {
+	limit uint
+	mu    sync.Mutex
+	// map of nameserver IP to a channel with a slot for each transfer in progress
+	slots map[string]chan struct{}
+}
+
+func newIPLimiter(limit uint) *ipLimiter {
+	return &ipLimiter{
+		limit: limit,
+		slots: make(map[string]chan struct{}),
+	}
+}
+
+// acquire waits for a free slot for ip and returns the function to release it
+// it returns the context's error if ctx is done first, a nil ipLimiter never waits
+func (l *ipLimiter) acquire(ctx context.Context, ip net.IP) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	key := ip.String()
+	l.mu.Lock()
+	slot, ok := l.slots[key]
+	if !ok {
+		slot = make(chan struct{}, l.limit)
+		l.slots[key] = slot
+	}
+	l.mu.Unlock()
+	select {
+	case slot <- struct{}{}:
+		return func() { <-slot }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
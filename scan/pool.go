@@ -0,0 +1,103 @@
+package scan
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// poolIdleTimeout is how long an idle connection is kept, less than the idle timeout of common servers
+	poolIdleTimeout = 10 * time.Second
+	// poolMaxIdle is the number of idle connections kept to each server
+	poolMaxIdle = 2
+	// poolMaxIdleTotal is the number of idle connections kept to all servers
+	poolMaxIdleTotal = 64
+)
+
+// connPool keeps idle TCP connections to DNS servers so that sequential queries to the same server reuse them
+// the zero value is ready to use
+type connPool struct {
+	mu sync.Mutex
+	// map of server to its idle connections, the most recently used last
+	idle  map[string][]idleConn
+	total int
+}
+
+// idleConn is a connection waiting in the pool
+type idleConn struct {
+	conn  *dns.Conn
+	since time.Time
+}
+
+// get returns an idle connection to server or nil if there are none
+func (p *connPool) get(server string) *dns.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[server]
+	for len(conns) > 0 {
+		c := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		p.total--
+		if time.Since(c.since) < poolIdleTimeout {
+			p.idle[server] = conns
+			return c.conn
+		}
+		c.conn.Close()
+	}
+	delete(p.idle, server)
+	return nil
+}
+
+// put returns a connection to server to the pool, closing it if the pool is full
+func (p *connPool) put(server string, conn *dns.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.idle == nil {
+		p.idle = make(map[string][]idleConn)
+	}
+	if len(p.idle[server]) >= poolMaxIdle || p.total >= poolMaxIdleTotal {
+		conn.Close()
+		return
+	}
+	p.idle[server] = append(p.idle[server], idleConn{conn: conn, since: time.Now()})
+	p.total++
+}
+
+// close closes every idle connection
+func (p *connPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conns := range p.idle {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+	}
+	p.idle = nil
+	p.total = 0
+}
+
+// exchange sends m to server over an idle connection if there is one, or a new connection from client
+// a request on an idle connection that the server has since closed is resent once on a new connection
+func (p *connPool) exchange(client *dns.Client, m *dns.Msg, server string) (*dns.Msg, error) {
+	if conn := p.get(server); conn != nil {
+		in, _, err := client.ExchangeWithConn(m, conn)
+		if err == nil {
+			p.put(server, conn)
+			return in, nil
+		}
+		conn.Close()
+	}
+	conn, err := client.Dial(server)
+	if err != nil {
+		return nil, err
+	}
+	in, _, err := client.ExchangeWithConn(m, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.put(server, conn)
+	return in, nil
+}
@@ -0,0 +1,402 @@
+package scan
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lanrat/allxfr/logger"
+
+	"github.com/miekg/dns"
+)
+
+// errNXDomain is returned by queries for names that do not exist
+var errNXDomain = errors.New("NXDOMAIN")
+
+// queryRetryBackoff is the wait before resending a query that timed out, doubled for each retry
+const queryRetryBackoff = 100 * time.Millisecond
+
+// defaultNegativeTTL is how long a name that does not exist is remembered when the response has no SOA
+const defaultNegativeTTL = 5 * time.Minute
+
+// negativeCacheSize is the most names the negative cache holds, enough for the missing nameservers of a large scan
+const negativeCacheSize = 100000
+
+// negativeCache remembers names that do not exist until their negative TTL expires
+// NXDOMAIN applies to every type so a single entry short-circuits both the A and AAAA lookups of a host
+type negativeCache struct {
+	sync.Mutex
+	// map of server and name to expiration time
+	entries map[string]time.Time
+}
+
+// has returns true if name is known to not exist on server
+func (c *negativeCache) has(server, name string) bool {
+	key := server + " " + strings.ToLower(name)
+	c.Lock()
+	defer c.Unlock()
+	expires, ok := c.entries[key]
+	if ok && time.Now().After(expires) {
+		delete(c.entries, key)
+		return false
+	}
+	return ok
+}
+
+// add remembers that name does not exist on server, using the negative TTL from the response's SOA if present
+func (c *negativeCache) add(server, name string, in *dns.Msg) {
+	ttl := defaultNegativeTTL
+	for _, rr := range in.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl = time.Duration(min(soa.Hdr.Ttl, soa.Minttl)) * time.Second
+			break
+		}
+	}
+	key := server + " " + strings.ToLower(name)
+	c.Lock()
+	defer c.Unlock()
+	if len(c.entries) >= negativeCacheSize {
+		c.evict()
+	}
+	c.entries[key] = time.Now().Add(ttl)
+}
+
+// evict removes the expired entries and then random entries until the cache is below nine tenths of negativeCacheSize
+// so that a full cache is not swept again on every add, it must be called with the lock held
+func (c *negativeCache) evict() {
+	now := time.Now()
+	for key, expires := range c.entries {
+		if now.After(expires) {
+			delete(c.entries, key)
+		}
+	}
+	// map iteration order is random
+	for key := range c.entries {
+		if len(c.entries) < negativeCacheSize*9/10 {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+// exchange sends m to server and returns the response
+// concurrent identical queries share a single exchange, the returned message must not be modified
+// errNXDomain is returned for names that do not exist, and they are not queried again until their negative TTL expires
+func (s *Scanner) exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	return s.exchangeNet(m, server, false)
+}
+
+// exchangeNet is exchange always sent over TCP if tcp is set
+func (s *Scanner) exchangeNet(m *dns.Msg, server string, tcp bool) (*dns.Msg, error) {
+	q := m.Question[0]
+	if s.nxCache.has(server, q.Name) {
+		return nil, fmt.Errorf("%s: %w (cached)", q.Name, errNXDomain)
+	}
+	key := fmt.Sprintf("%s %s %d %d %t", server, strings.ToLower(q.Name), q.Qclass, q.Qtype, tcp)
+	r, err, _ := s.queryGroup.Do(key, func() (interface{}, error) {
+		if s.cookies != nil {
+			return s.exchangeCookie(m, server, tcp)
+		}
+		in, err := s.clientExchange(m, server, tcp)
+		if err == nil && in.Rcode == dns.RcodeNameError {
+			s.nxCache.add(server, q.Name, in)
+		}
+		return in, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	in := r.(*dns.Msg)
+	if in.Rcode == dns.RcodeNameError {
+		return nil, fmt.Errorf("%s: %w", q.Name, errNXDomain)
+	}
+	return in, nil
+}
+
+// clientExchange sends m to server, resending it over TCP if the UDP answer was truncated
+// so that large answers such as the NS set of a zone with many nameservers are complete
+// m is only sent over TCP if tcp is set
+// UDP queries that time out are resent QueryRetries times so packet loss does not fail an otherwise good server
+// TCP connections are reused for sequential queries to the same server
+func (s *Scanner) clientExchange(m *dns.Msg, server string, tcp bool) (*dns.Msg, error) {
+	if tcp || s.client.Net == "tcp" {
+		return s.tcpPool.exchange(&s.tcpClient, m, server)
+	}
+	in, _, err := s.client.Exchange(m, server)
+	var netErr net.Error
+	for try := 0; try < s.opts.QueryRetries && errors.As(err, &netErr) && netErr.Timeout(); try++ {
+		s.log.Trace(logger.Fields{}, "dns query to %s timed out, resending", server)
+		time.Sleep(queryRetryBackoff << try)
+		in, _, err = s.client.Exchange(m, server)
+	}
+	if err != nil || !in.Truncated {
+		return in, err
+	}
+	s.log.Trace(logger.Fields{}, "dns answer from %s truncated, retrying over TCP", server)
+	return s.tcpPool.exchange(&s.tcpClient, m, server)
+}
+
+// exchangeCookie sends m to server with a DNS cookie, resending it once with the new server cookie if it is rejected
+func (s *Scanner) exchangeCookie(m *dns.Msg, server string, tcp bool) (*dns.Msg, error) {
+	var in *dns.Msg
+	var err error
+	for try := 0; try < 2; try++ {
+		s.cookies.add(m, server)
+		in, err = s.clientExchange(m, server, tcp)
+		if err != nil {
+			return nil, err
+		}
+		s.cookies.update(server, in)
+		if in.Rcode != dns.RcodeBadCookie {
+			break
+		}
+	}
+	if in.Rcode == dns.RcodeNameError {
+		s.nxCache.add(server, m.Question[0].Name, in)
+	}
+	return in, nil
+}
+
+// versionNames are the CHAOS TXT names nameservers answer with their software version, in the order they are tried
+var versionNames = []string{"version.bind.", "version.server."}
+
+// nsVersion returns the version banner of the nameserver at ip or an empty string if it does not give one
+// each IP is only queried once
+func (s *Scanner) nsVersion(ip net.IP) string {
+	key := ip.String()
+	s.versionsMu.Lock()
+	version, ok := s.versions[key]
+	s.versionsMu.Unlock()
+	if ok {
+		return version
+	}
+	server := net.JoinHostPort(key, s.port)
+	for _, name := range versionNames {
+		var err error
+		version, err = s.queryVersion(server, name)
+		if err != nil {
+			s.log.Debug(logger.Fields{IP: ip}, "%s", err)
+			continue
+		}
+		if len(version) > 0 {
+			break
+		}
+	}
+	s.versionsMu.Lock()
+	s.versions[key] = version
+	s.versionsMu.Unlock()
+	return version
+}
+
+// version returns the nameserver version of ip if NSVersion is set
+func (s *Scanner) version(ip net.IP) string {
+	if !s.opts.NSVersion {
+		return ""
+	}
+	return s.nsVersion(ip)
+}
+
+// queryVersion returns the TXT record of name in the CHAOS class from server
+func (s *Scanner) queryVersion(server, name string) (string, error) {
+	s.log.Trace(logger.Fields{}, "dns query: @%s CH TXT %s", server, name)
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeTXT)
+	m.Question[0].Qclass = dns.ClassCHAOS
+
+	in, err := s.exchange(m, server)
+	if err != nil {
+		return "", err
+	}
+	for i := range in.Answer {
+		if t, ok := in.Answer[i].(*dns.TXT); ok {
+			// banners are saved as a single comment line
+			return strings.Join(strings.Fields(strings.Join(t.Txt, " ")), " "), nil
+		}
+	}
+	return "", nil
+}
+
+// NOTE: these query functions are not fully recursive
+// they are meant to be used with a fully recursive resolver like unbound/bind/named
+
+// LookupNS returns the nameservers of domain from the configured nameserver
+func (s *Scanner) LookupNS(domain string) ([]string, error) {
+	return s.queryNS(s.opts.Nameserver, domain)
+}
+
+// LookupIP returns the addresses of host from the configured nameserver, skipping any address family not in use
+func (s *Scanner) LookupIP(host string) ([]net.IP, error) {
+	return s.queryIP(s.opts.Nameserver, host)
+}
+
+func (s *Scanner) queryNS(server, domain string) ([]string, error) {
+	domain = dns.Fqdn(domain)
+	s.log.Trace(logger.Fields{}, "dns query: @%s NS %s", server, domain)
+	m := new(dns.Msg)
+	m.SetQuestion(domain, dns.TypeNS)
+
+	in, err := s.exchange(m, server)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0, 2)
+	out = s.addNS(out, server, domain, in)
+	if s.opts.NSUnion && s.client.Net != "tcp" {
+		// some servers answer with different or additional nameservers over TCP
+		s.log.Trace(logger.Fields{}, "dns query: @%s NS %s over TCP", server, domain)
+		tcpIn, err := s.exchangeNet(m, server, true)
+		if err != nil {
+			s.log.Debug(logger.Fields{Zone: domain}, "%s", err)
+		} else {
+			out = s.addNS(out, server, domain, tcpIn)
+		}
+	}
+
+	return out, nil
+}
+
+// addNS adds the nameservers in the answer in that are not already in out
+func (s *Scanner) addNS(out []string, server, domain string, in *dns.Msg) []string {
+	for i := range in.Answer {
+		if t, ok := in.Answer[i].(*dns.NS); ok {
+			s.log.Trace(logger.Fields{}, "dns answer NS @%s\t%s:\t%s\n", server, domain, t.Ns)
+			ns := strings.ToLower(t.Ns)
+			if !slices.Contains(out, ns) {
+				out = append(out, ns)
+			}
+		}
+	}
+	return out
+}
+
+// queryMNAME returns the primary master nameserver from the SOA of domain, or an empty string if it has no SOA
+func (s *Scanner) queryMNAME(server, domain string) (string, error) {
+	domain = dns.Fqdn(domain)
+	s.log.Trace(logger.Fields{}, "dns query: @%s SOA %s", server, domain)
+	m := new(dns.Msg)
+	m.SetQuestion(domain, dns.TypeSOA)
+
+	in, err := s.exchange(m, server)
+	if err != nil {
+		return "", err
+	}
+
+	for i := range in.Answer {
+		if t, ok := in.Answer[i].(*dns.SOA); ok && strings.EqualFold(t.Hdr.Name, domain) {
+			s.log.Trace(logger.Fields{}, "dns answer SOA @%s\t%s:\t%s\n", server, domain, t.Ns)
+			return strings.ToLower(t.Ns), nil
+		}
+	}
+
+	return "", nil
+}
+
+// querySerial returns the serial of the SOA of domain from the authoritative server
+func (s *Scanner) querySerial(server, domain string) (uint32, error) {
+	domain = dns.Fqdn(domain)
+	s.log.Trace(logger.Fields{}, "dns query: @%s SOA %s", server, domain)
+	m := new(dns.Msg)
+	m.SetQuestion(domain, dns.TypeSOA)
+	m.RecursionDesired = false
+
+	in, err := s.exchange(m, server)
+	if err != nil {
+		return 0, err
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("SOA %s: %s", domain, dns.RcodeToString[in.Rcode])
+	}
+
+	for i := range in.Answer {
+		if t, ok := in.Answer[i].(*dns.SOA); ok && strings.EqualFold(t.Hdr.Name, domain) {
+			s.log.Trace(logger.Fields{}, "dns answer SOA @%s\t%s:\t%d\n", server, domain, t.Serial)
+			return t.Serial, nil
+		}
+	}
+	return 0, fmt.Errorf("SOA %s: no answer", domain)
+}
+
+func (s *Scanner) queryA(server, domain string) ([]net.IP, error) {
+	domain = dns.Fqdn(domain)
+	s.log.Trace(logger.Fields{}, "dns query: @%s A %s", server, domain)
+	m := new(dns.Msg)
+	m.SetQuestion(domain, dns.TypeA)
+
+	in, err := s.exchange(m, server)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]net.IP, 0, 1)
+	for i := range in.Answer {
+		if t, ok := in.Answer[i].(*dns.A); ok {
+			s.log.Trace(logger.Fields{}, "dns answer A @%s\t%s:\t%s\n", server, domain, t.A.String())
+			out = append(out, t.A)
+		}
+	}
+
+	return out, nil
+}
+
+func (s *Scanner) queryAAAA(server, domain string) ([]net.IP, error) {
+	domain = dns.Fqdn(domain)
+	s.log.Trace(logger.Fields{}, "dns query: @%s AAAA %s", server, domain)
+	m := new(dns.Msg)
+	m.SetQuestion(domain, dns.TypeAAAA)
+
+	in, err := s.exchange(m, server)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]net.IP, 0, 1)
+	for i := range in.Answer {
+		if t, ok := in.Answer[i].(*dns.AAAA); ok {
+			s.log.Trace(logger.Fields{}, "dns answer AAAA @%s\t%s:\t%s\n", server, domain, t.AAAA.String())
+			out = append(out, t.AAAA)
+		}
+	}
+
+	return out, nil
+}
+
+// queryIP returns the A and AAAA records for domain, skipping any address family disabled by IPv4Only or IPv6Only
+func (s *Scanner) queryIP(server, domain string) ([]net.IP, error) {
+	var ips []net.IP
+	if s.wantIPv4() {
+		aIPs, err := s.queryA(server, domain)
+		if err != nil {
+			return aIPs, err
+		}
+		ips = aIPs
+	}
+	if s.wantIPv6() {
+		aaaaIPs, err := s.queryAAAA(server, domain)
+		return append(ips, aaaaIPs...), err
+	}
+	return ips, nil
+}
+
+// wantIPv4 returns true unless only IPv6 was requested
+func (s *Scanner) wantIPv4() bool {
+	return s.opts.IPv4Only || !s.opts.IPv6Only
+}
+
+// wantIPv6 returns true unless only IPv4 was requested
+func (s *Scanner) wantIPv6() bool {
+	return s.opts.IPv6Only || !s.opts.IPv4Only
+}
+
+// IPAllowed returns false if the IP's address family was disabled by IPv4Only or IPv6Only
+// IPv4-mapped IPv6 addresses are dialed over IPv4 so they are treated as IPv4
+func (s *Scanner) IPAllowed(ip net.IP) bool {
+	if ip.To4() != nil {
+		return s.wantIPv4()
+	}
+	return s.wantIPv6()
+}
@@ -0,0 +1,74 @@
+package scan
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLookupNSTruncated(t *testing.T) {
+	// far more nameservers than fit in a 512 byte UDP answer
+	var want []string
+	for i := 0; i < 40; i++ {
+		want = append(want, fmt.Sprintf("ns%d.a-long-nameserver-name.example.net.", i))
+	}
+	var udpQueries, tcpQueries atomic.Int32
+	mux := dns.NewServeMux()
+	mux.HandleFunc("big.example.", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, nameserver := range want {
+			m.Answer = append(m.Answer, &dns.NS{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300},
+				Ns:  nameserver,
+			})
+		}
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			udpQueries.Add(1)
+			m.Truncate(dns.MinMsgSize)
+		} else {
+			tcpQueries.Add(1)
+		}
+		w.WriteMsg(m)
+	})
+	port := startServer(t, mux, "127.0.0.1")
+	s := newTestScanner(t, Options{}, port)
+
+	got, err := s.LookupNS("big.example.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if udpQueries.Load() != 1 || tcpQueries.Load() != 1 {
+		t.Errorf("got %d UDP and %d TCP queries, want 1 of each", udpQueries.Load(), tcpQueries.Load())
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("got %d nameservers %v, want all %d", len(got), got, len(want))
+	}
+}
+
+func TestNegativeCacheSize(t *testing.T) {
+	c := negativeCache{entries: make(map[string]time.Time)}
+	in := new(dns.Msg)
+	for i := 0; i < negativeCacheSize; i++ {
+		c.add("127.0.0.1:53", fmt.Sprintf("%d.example.", i), in)
+	}
+	// expired entries are removed before any that are still valid
+	c.entries["127.0.0.1:53 expired.example."] = time.Now().Add(-time.Second)
+	c.add("127.0.0.1:53", "new.example.", in)
+	if len(c.entries) >= negativeCacheSize {
+		t.Errorf("cache has %d entries, want fewer than %d", len(c.entries), negativeCacheSize)
+	}
+	if _, ok := c.entries["127.0.0.1:53 expired.example."]; ok {
+		t.Error("expired entry kept")
+	}
+	if !c.has("127.0.0.1:53", "new.example.") {
+		t.Error("newest entry evicted")
+	}
+}
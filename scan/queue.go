@@ -0,0 +1,78 @@
+package scan
+
+import (
+	"context"
+	"sync"
+
+	"github.com/lanrat/allxfr/zone"
+)
+
+// target is a zone waiting to be attempted along with the zone holding its nameservers and their addresses
+type target struct {
+	domain string
+	z      zone.Zone
+	// resolve looks up the addresses of the nameservers in z without any before the zone is attempted
+	resolve bool
+}
+
+// workQueue hands targets to workers and accepts new targets while the scan is running
+// it is finished once it is empty and no target is still being worked on, as that is the only way more are added
+type workQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// targets waiting for a worker, taken from the front
+	targets []target
+	// outstanding is the number of targets queued or being worked on
+	outstanding int
+	// stopped is set once ctx is done
+	stopped bool
+}
+
+// newWorkQueue returns an empty queue that stops handing out targets once ctx is done
+func newWorkQueue(ctx context.Context) *workQueue {
+	q := &workQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.stopped = true
+		q.cond.Broadcast()
+	})
+	return q
+}
+
+// add queues targets to be attempted after those already queued
+func (q *workQueue) add(targets ...target) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.targets = append(q.targets, targets...)
+	q.outstanding += len(targets)
+	q.cond.Broadcast()
+}
+
+// next waits for a target, returning false once the queue is finished or stopped
+// every target returned must be passed to done after it has been attempted
+func (q *workQueue) next() (target, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.targets) == 0 && q.outstanding > 0 && !q.stopped {
+		q.cond.Wait()
+	}
+	if len(q.targets) == 0 || q.stopped {
+		return target{}, false
+	}
+	t := q.targets[0]
+	q.targets[0] = target{}
+	q.targets = q.targets[1:]
+	return t, true
+}
+
+// done marks a target returned by next as finished
+func (q *workQueue) done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.outstanding--
+	if q.outstanding == 0 {
+		q.cond.Broadcast()
+	}
+}
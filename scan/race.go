@@ -0,0 +1,71 @@
+package scan
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// raceTarget is a nameserver IP attempted at the same time as the others of a zone for RaceNS
+type raceTarget struct {
+	nameserver string
+	ip         net.IP
+}
+
+// raceClaim is taken by the first transfer of a race to receive records
+type raceClaim struct {
+	taken atomic.Bool
+}
+
+// take returns true the first time it is called
+func (c *raceClaim) take() bool {
+	return c.taken.CompareAndSwap(false, true)
+}
+
+// raceAXFR attempts transfers of domain from every target at the same time and saves the first that sends records
+// the other transfers are canceled once it finishes
+func (s *Scanner) raceAXFR(ctx context.Context, domain string, targets []raceTarget) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	claim := new(raceClaim)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var records int64
+	var err error
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target raceTarget) {
+			defer wg.Done()
+			n, terr := s.axfrRetry(ctx, domain, target.nameserver, target.ip, claim)
+			mu.Lock()
+			defer mu.Unlock()
+			if terr != nil && err == nil {
+				err = terr
+			}
+			if n > 0 {
+				records = n
+				cancel()
+			} else if n < 0 && records == 0 {
+				records = n
+			}
+		}(target)
+	}
+	wg.Wait()
+	return records, err
+}
+
+// prependEnvelope returns a channel that yields first and then everything from env
+func prependEnvelope(first *dns.Envelope, env chan *dns.Envelope) chan *dns.Envelope {
+	out := make(chan *dns.Envelope)
+	go func() {
+		defer close(out)
+		out <- first
+		for e := range env {
+			out <- e
+		}
+	}()
+	return out
+}
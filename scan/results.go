@@ -0,0 +1,274 @@
+package scan
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// scanResults records which zones were attempted, which transfers succeeded and why the others failed
+type scanResults struct {
+	sync.Mutex
+	attempted map[string]bool
+	transfers []TransferResult
+	// map of zone to nameserver IP to the last error seen from it
+	errors map[string]map[string]string
+	probes []ProbeResult
+	// map of zone to the record sets received from each nameserver IP for Compare
+	recordSets map[string][]RecordSet
+	mismatches []ZoneMismatch
+	// number of records of each type in saved zones
+	recordTypes map[uint16]uint64
+	serials     []ZoneSerials
+	delegations []DelegationMismatch
+	// map of zone to the number of wildcard owner names it has
+	wildcards map[string]int
+}
+
+// results of a DryRun attempt against a single nameserver IP
+const (
+	ProbeAllowed = "allowed"
+	ProbeRefused = "refused"
+	ProbeTimeout = "timeout"
+	ProbeError   = "error"
+)
+
+// ProbeResult is the outcome of a DryRun attempt against a single nameserver IP
+type ProbeResult struct {
+	Zone       string `json:"zone"`
+	Nameserver string `json:"nameserver"`
+	IP         string `json:"ip"`
+	Result     string `json:"result"`
+	// Rcode is the rcode a refused attempt was answered with, such as REFUSED or NOTAUTH
+	Rcode string `json:"rcode,omitempty"`
+	// number of records in the first envelope when allowed
+	Records   int64  `json:"records,omitempty"`
+	NSVersion string `json:"ns_version,omitempty"`
+}
+
+// TransferResult is a single successful zone transfer
+type TransferResult struct {
+	Zone       string `json:"zone"`
+	Nameserver string `json:"nameserver"`
+	IP         string `json:"ip"`
+	Records    int64  `json:"records"`
+	NSVersion  string `json:"ns_version,omitempty"`
+}
+
+// ZoneFailure is a zone that was attempted without any successful transfer
+type ZoneFailure struct {
+	Zone string `json:"zone"`
+	// Reasons is the last error from each nameserver IP, prefixed with refused-but-soa-ok, refused-and-soa-failed,
+	// no-response or truncated when the failure could be classified
+	// a zone abandoned after ZoneTimeout also has the reason under the key zone
+	Reasons map[string]string `json:"reasons,omitempty"`
+}
+
+// Results is the outcome of a scan
+type Results struct {
+	// Zones is the number of zones to transfer and Attempted the number that were tried before the scan ended
+	Zones     int `json:"zones"`
+	Attempted int `json:"attempted"`
+	// ZonesTransferred is the number of zones with at least one successful transfer
+	ZonesTransferred int `json:"zones_transferred"`
+	// Transferred is the number of successful transfers, which can be more than one per zone with SaveAll
+	Transferred   uint32           `json:"transferred"`
+	ExcludedZones uint32           `json:"excluded_zones"`
+	ExcludedIPs   uint32           `json:"excluded_ips"`
+	PrivateIPs    uint32           `json:"private_ips"`
+	Transfers     []TransferResult `json:"transfers"`
+	Failures      []ZoneFailure    `json:"failures"`
+	Probes        []ProbeResult    `json:"probes,omitempty"`
+	Mismatches    []ZoneMismatch   `json:"mismatches,omitempty"`
+	Serials       []ZoneSerials    `json:"serials,omitempty"`
+	// Subzones is the number of zones found delegated from transferred zones for SubzoneDepth, included in Zones
+	Subzones int `json:"subzones,omitempty"`
+	// DelegationMismatches are the zones whose parent delegates them to different nameservers than they report
+	DelegationMismatches []DelegationMismatch `json:"delegation_mismatches,omitempty"`
+	// GlueNameservers is the number of nameservers of attempted zones with addresses in the zone
+	GlueNameservers uint32 `json:"glue_nameservers"`
+	// MissingGlueNameservers is the number of nameservers of attempted zones whose addresses had to be resolved
+	MissingGlueNameservers uint32 `json:"missing_glue_nameservers"`
+	// ZonesWithoutGlue is the number of attempted zones without addresses for any of their nameservers
+	ZonesWithoutGlue uint32 `json:"zones_without_glue"`
+	// RecordTypes is the number of records of each type in the saved zones
+	RecordTypes map[string]uint64 `json:"record_types,omitempty"`
+	// Wildcards is the number of wildcard owner names in each transferred zone that has any
+	Wildcards map[string]int `json:"wildcards,omitempty"`
+	// records not passed to OnRecord because of DropRecords
+	DroppedRecords uint64 `json:"dropped_records,omitempty"`
+	// StoppedEarly is why the scan stopped before trying every zone, such as the context's deadline
+	StoppedEarly   string  `json:"stopped_early,omitempty"`
+	Runtime        string  `json:"runtime"`
+	RuntimeSeconds float64 `json:"runtime_seconds"`
+}
+
+func newScanResults() *scanResults {
+	return &scanResults{
+		attempted:   make(map[string]bool),
+		errors:      make(map[string]map[string]string),
+		recordSets:  make(map[string][]RecordSet),
+		recordTypes: make(map[uint16]uint64),
+		wildcards:   make(map[string]int),
+	}
+}
+
+// attempt records that a transfer of zone is being attempted
+func (r *scanResults) attempt(zone string) {
+	r.Lock()
+	defer r.Unlock()
+	r.attempted[zone] = true
+}
+
+// transfer records a successful transfer and returns its result
+func (r *scanResults) transfer(zone, nameserver string, ip net.IP, records int64, version string) TransferResult {
+	t := TransferResult{
+		Zone:       zone,
+		Nameserver: nameserver,
+		IP:         ip.String(),
+		Records:    records,
+		NSVersion:  version,
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.transfers = append(r.transfers, t)
+	return t
+}
+
+// fail records why a transfer of zone from ip failed
+func (r *scanResults) fail(zone, nameserver string, ip net.IP, err error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.errors[zone] == nil {
+		r.errors[zone] = make(map[string]string)
+	}
+	r.errors[zone][nameserver+" "+ip.String()] = err.Error()
+}
+
+// abandonedKey is the key in the reasons of a zone failure for why the whole zone was abandoned
+const abandonedKey = "zone"
+
+// abandon records why zone was abandoned before every nameserver IP was tried
+func (r *scanResults) abandon(zone string, err error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.errors[zone] == nil {
+		r.errors[zone] = make(map[string]string)
+	}
+	r.errors[zone][abandonedKey] = err.Error()
+}
+
+// countTypes adds the number of records of each type in a saved zone
+func (r *scanResults) countTypes(counts map[uint16]uint64) {
+	r.Lock()
+	defer r.Unlock()
+	for rrtype, n := range counts {
+		r.recordTypes[rrtype] += n
+	}
+}
+
+// addWildcards records that a transferred zone has n wildcard owner names
+func (r *scanResults) addWildcards(zone string, n int) {
+	r.Lock()
+	defer r.Unlock()
+	r.wildcards[zone] = max(r.wildcards[zone], n)
+}
+
+// probe records the result of a DryRun attempt
+func (r *scanResults) probe(zone, nameserver string, ip net.IP, result, rcode string, records int64, version string) {
+	r.Lock()
+	defer r.Unlock()
+	if records < 0 {
+		records = 0
+	}
+	r.probes = append(r.probes, ProbeResult{
+		Zone:       zone,
+		Nameserver: nameserver,
+		IP:         ip.String(),
+		Result:     result,
+		Rcode:      rcode,
+		Records:    records,
+		NSVersion:  version,
+	})
+}
+
+// Allowed returns the DryRun attempts that allowed a transfer sorted by zone
+func (r Results) Allowed() []ProbeResult {
+	out := make([]ProbeResult, 0)
+	for _, p := range r.Probes {
+		if p.Result == ProbeAllowed {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// summary returns the aggregated results of the scan so far
+func (r *scanResults) summary(scanner *Scanner, zones int, runtime time.Duration) Results {
+	transferred, excludedZones, excludedIPs := scanner.totals()
+	r.Lock()
+	defer r.Unlock()
+	s := Results{
+		Zones:          zones,
+		Attempted:      len(r.attempted),
+		Transferred:    transferred,
+		ExcludedZones:  excludedZones,
+		ExcludedIPs:    excludedIPs,
+		PrivateIPs:     atomic.LoadUint32(&scanner.totalPrivateIPs),
+		Transfers:      append([]TransferResult{}, r.transfers...),
+		Failures:       make([]ZoneFailure, 0, len(r.attempted)),
+		Probes:         append([]ProbeResult{}, r.probes...),
+		Mismatches:     append([]ZoneMismatch{}, r.mismatches...),
+		Serials:        append([]ZoneSerials{}, r.serials...),
+		RecordTypes:    make(map[string]uint64, len(r.recordTypes)),
+		DroppedRecords: atomic.LoadUint64(&scanner.droppedRecords),
+		Runtime:        runtime.String(),
+		RuntimeSeconds: runtime.Seconds(),
+	}
+	s.Subzones = scanner.subzones.count()
+	s.DelegationMismatches = append([]DelegationMismatch{}, r.delegations...)
+	s.GlueNameservers = atomic.LoadUint32(&scanner.totalGlue)
+	s.MissingGlueNameservers = atomic.LoadUint32(&scanner.totalMissingGlue)
+	s.ZonesWithoutGlue = atomic.LoadUint32(&scanner.totalZonesWithoutGlue)
+	s.Wildcards = make(map[string]int, len(r.wildcards))
+	for zone, n := range r.wildcards {
+		s.Wildcards[zone] = n
+	}
+	for rrtype, n := range r.recordTypes {
+		s.RecordTypes[dns.Type(rrtype).String()] += n
+	}
+	succeeded := make(map[string]bool)
+	for _, t := range r.transfers {
+		succeeded[t.Zone] = true
+	}
+	s.ZonesTransferred = len(succeeded)
+	for zone := range r.attempted {
+		if !succeeded[zone] {
+			s.Failures = append(s.Failures, ZoneFailure{Zone: zone, Reasons: r.errors[zone]})
+		}
+	}
+	sort.Slice(s.Transfers, func(i, j int) bool { return s.Transfers[i].Zone < s.Transfers[j].Zone })
+	sort.Slice(s.Failures, func(i, j int) bool { return s.Failures[i].Zone < s.Failures[j].Zone })
+	sortProbes(s.Probes)
+	sort.Slice(s.Mismatches, func(i, j int) bool { return s.Mismatches[i].Zone < s.Mismatches[j].Zone })
+	sortSerials(s.Serials)
+	sort.Slice(s.DelegationMismatches, func(i, j int) bool { return s.DelegationMismatches[i].Zone < s.DelegationMismatches[j].Zone })
+	return s
+}
+
+// sortProbes sorts by zone, nameserver and then IP
+func sortProbes(probes []ProbeResult) {
+	sort.Slice(probes, func(i, j int) bool {
+		if probes[i].Zone != probes[j].Zone {
+			return probes[i].Zone < probes[j].Zone
+		}
+		if probes[i].Nameserver != probes[j].Nameserver {
+			return probes[i].Nameserver < probes[j].Nameserver
+		}
+		return probes[i].IP < probes[j].IP
+	})
+}
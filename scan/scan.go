@@ -0,0 +1,466 @@
+// Package scan attempts zone transfers of every zone in a zone.Zone from all of its nameservers
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lanrat/allxfr/logger"
+	"github.com/lanrat/allxfr/save"
+	"github.com/lanrat/allxfr/zone"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+)
+
+// Options configures a Scanner
+type Options struct {
+	// Parallel is the number of zones to transfer at the same time
+	Parallel uint
+	// SaveDir is the directory transferred zones are saved in
+	SaveDir string
+	// SaveDirs shards the zone files between several directories by a hash of the zone name instead of SaveDir
+	// a zone is always saved in the same directory for the same list
+	SaveDirs []string
+	// Layout is how zone files are arranged in SaveDir, one of LayoutFlat, LayoutTLD or LayoutHashed, flat if empty
+	Layout string
+	// SaveAll attempts a transfer from every nameserver of a zone and saves each of them
+	SaveAll bool
+	// Serials queries every other nameserver IP of a zone for its SOA serial after it is transferred, can not be used with SaveAll
+	Serials bool
+	// MaxNSIPs is the maximum number of distinct nameserver IPs tried for each zone, 0 for unlimited
+	MaxNSIPs int
+	// RaceNS attempts transfers from all of a zone's nameserver IPs at the same time and saves the first to send records
+	RaceNS bool
+	// Nameserver is the recursive resolver used for all lookups as host:port
+	Nameserver string
+	// QueryNameservers looks up the nameservers of each zone with Nameserver and also tries any IPs missing from the zone
+	QueryNameservers bool
+	// NSUnion queries the nameservers of each zone over both UDP and TCP and uses every nameserver in either answer
+	NSUnion bool
+	// SubzoneDepth also attempts the zones delegated by NS records in transferred zones, and the zones delegated from
+	// those, up to this many levels below the starting zones, 0 to only attempt the starting zones
+	SubzoneDepth int
+	// ParentNS also asks the nameservers of each zone's parent for its delegation and tries any nameservers it lists, requires QueryNameservers
+	ParentNS bool
+	// IXFR requests an IXFR instead of an AXFR
+	IXFR bool
+	// DryRun only checks if transfers are allowed by retrieving a single envelope without saving anything
+	DryRun bool
+	// Retry is the number of times to try each failed operation
+	Retry int
+	// QueryRetries is the number of times a DNS query over UDP that times out is resent to the same server before it fails
+	QueryRetries int
+	// Overwrite replaces zones that already exist in SaveDir
+	Overwrite bool
+	// Diff saves only the records added and removed since a zone that already exists in SaveDir to a .diff file next to it
+	Diff bool
+	// KeepPartial saves the records of transfers that fail, are canceled or are aborted part way to a .partial.zone file
+	// instead of discarding them, if the Sink is a save.PartialSink
+	KeepPartial bool
+	// Sort sorts the records in saved zone files
+	Sort bool
+	// Meta also saves the metadata of each zone to a .meta.json file
+	Meta bool
+	// GzipLevel is the gzip compression level of saved zones from 1 to 9, 0 for the default level
+	GzipLevel int
+	// Uncompressed saves plain text .zone files instead of gzip
+	Uncompressed bool
+	// MaxOpenFiles is the number of zone files that can be open at the same time before transfers wait,
+	// 0 for half of the soft limit on open files and negative for unlimited
+	MaxOpenFiles int
+	// TCP uses TCP instead of UDP for DNS queries
+	TCP bool
+	// Cookies sends a DNS cookie (RFC 7873) with every query other than zone transfers and remembers each server's cookie
+	Cookies bool
+	// IPv4Only and IPv6Only limit the nameserver addresses used to a single address family
+	IPv4Only bool
+	IPv6Only bool
+	// SourceIP is the local address of all queries and transfers, which limits nameserver addresses to its address family
+	SourceIP net.IP
+	// Timeout is the timeout for dialing, reading and writing each DNS query and zone transfer
+	Timeout time.Duration
+	// ZoneTimeout is the longest time spent on all of the attempts to transfer a single zone, 0 for no limit
+	ZoneTimeout time.Duration
+	// BandwidthLimit limits the combined download rate of all transfers in bytes per second, 0 for unlimited
+	BandwidthLimit uint
+	// PerIP is the maximum number of transfers from a single nameserver IP at the same time, 0 for unlimited
+	PerIP uint
+	// ZoneRate is the maximum number of zones to start transferring per second, 0 for unlimited
+	ZoneRate float64
+	// Shuffle transfers the zones in a random order from Seed, a time based seed is used if Seed is 0
+	Shuffle bool
+	Seed    int64
+	// Interleave reorders shuffled zones so that consecutive zones do not share a nameserver where possible
+	Interleave bool
+	// MaxRecords and MaxSize abort transfers with more records or bytes of wire format records, 0 for unlimited
+	MaxRecords int64
+	MaxSize    int64
+	// Compare compares the records returned by each nameserver of a zone, requires SaveAll
+	Compare bool
+	// Exclude lists the zones and nameserver IPs to never transfer from
+	Exclude *ExcludeList
+	// AllowPrivate allows transfers from private, loopback and reserved nameserver IPs, which are skipped by default
+	AllowPrivate bool
+	// NSVersion queries each nameserver IP for its software version with version.bind and version.server
+	NSVersion bool
+	// Verbosity is the logger.Verbosity level used when Logger is not set
+	Verbosity int
+	// Logger writes the scan's log lines, a human readable logger to stderr is used if not set
+	Logger *logger.Logger
+	// OnRecord is called with every record as it is transferred, including records of transfers that are later aborted
+	// it is called from a single goroutine so it does not need to be safe for concurrent use
+	OnRecord func(zone string, rr dns.RR)
+	// RecordBuffer is the number of records waiting for OnRecord before transfers block, or drop them with DropRecords
+	RecordBuffer int
+	// DropRecords drops records instead of blocking transfers when OnRecord falls behind
+	DropRecords bool
+	// OnTransfer is called with every successful transfer as soon as it finishes
+	// it can be called from multiple goroutines at the same time
+	OnTransfer func(TransferResult)
+	// NewSink returns where each transfer is saved instead of the zone files in SaveDir
+	// returning a nil Sink skips the transfer
+	NewSink SinkFactory
+}
+
+// SinkFactory returns the sink to save a transfer of zone from nameserver at ip to, or a nil Sink to skip it
+// it is called from multiple goroutines at the same time
+type SinkFactory func(zone, nameserver string, ip net.IP) (save.Sink, error)
+
+// Scanner transfers zones according to its Options
+type Scanner struct {
+	opts Options
+	log  *logger.Logger
+	// port is the port nameservers are queried and transferred from, only changed by tests
+	port string
+	// client is used for all DNS lookups other than zone transfers
+	client dns.Client
+	// tcpClient sends lookups over TCP, including those with truncated UDP answers
+	tcpClient dns.Client
+	// tcpPool reuses the TCP connections of lookups
+	tcpPool connPool
+	// queryGroup deduplicates identical queries that are in flight at the same time
+	queryGroup singleflight.Group
+	nxCache    negativeCache
+	// cookies holds the DNS cookies of each server when Cookies is set
+	cookies *cookieJar
+	// map of nameserver IP to its version for NSVersion
+	versions   map[string]string
+	versionsMu sync.Mutex
+	// bwLimiter is shared by all transfers when BandwidthLimit is set
+	bwLimiter *rate.Limiter
+	// zoneLimiter is shared by all workers when ZoneRate is set
+	zoneLimiter *rate.Limiter
+	// ipLimiter is shared by all workers when PerIP is set
+	ipLimiter *ipLimiter
+	// fileLimit is shared by all zone files for MaxOpenFiles
+	fileLimit *save.FileLimit
+	results   *scanResults
+	// records waiting for OnRecord
+	records        chan record
+	droppedRecords uint64
+	totalXFR       uint32
+	// zones and nameserver IPs skipped because of Exclude
+	totalExcludedZones uint32
+	totalExcludedIPs   uint32
+	// nameserver IPs skipped because they are private or reserved
+	totalPrivateIPs uint32
+	// nameservers of attempted zones with and without addresses in the zone
+	totalGlue        uint32
+	totalMissingGlue uint32
+	// attempted zones without addresses in the zone for any of their nameservers
+	totalZonesWithoutGlue uint32
+	// queue holds the zones waiting for a worker
+	queue *workQueue
+	// subzones found in transferred zones for SubzoneDepth
+	subzones subzoneSet
+}
+
+// New returns a Scanner for opts
+func New(opts Options) (*Scanner, error) {
+	if opts.Parallel == 0 {
+		return nil, errors.New("parallel must be positive")
+	}
+	if opts.Retry < 1 {
+		return nil, errors.New("retry must be positive")
+	}
+	if opts.QueryRetries < 0 {
+		return nil, errors.New("query retries must not be negative")
+	}
+	if opts.Timeout <= 0 {
+		return nil, errors.New("timeout must be positive")
+	}
+	if opts.ZoneTimeout < 0 {
+		return nil, errors.New("zone timeout must not be negative")
+	}
+	if opts.SubzoneDepth < 0 {
+		return nil, errors.New("subzone depth must not be negative")
+	}
+	if opts.MaxNSIPs < 0 {
+		return nil, errors.New("max ns ips must not be negative")
+	}
+	if opts.ZoneRate < 0 {
+		return nil, errors.New("rate must not be negative")
+	}
+	if len(opts.Nameserver) == 0 {
+		return nil, errors.New("nameserver is required")
+	}
+	if opts.Compare && !opts.SaveAll {
+		return nil, errors.New("compare requires save all")
+	}
+	if opts.Serials && opts.SaveAll {
+		return nil, errors.New("serials can not be used with save all")
+	}
+	if opts.ParentNS && !opts.QueryNameservers {
+		return nil, errors.New("parent ns requires query nameservers")
+	}
+	if opts.RaceNS && (opts.SaveAll || opts.DryRun) {
+		return nil, errors.New("race ns can not be used with save all or dry run")
+	}
+	if opts.Interleave && !opts.Shuffle {
+		return nil, errors.New("interleave requires shuffle")
+	}
+	if opts.GzipLevel < 0 || opts.GzipLevel > 9 {
+		return nil, errors.New("gzip level must be between 0 and 9, 0 for the default level")
+	}
+	switch opts.Layout {
+	case "", LayoutFlat, LayoutTLD, LayoutHashed:
+	default:
+		return nil, fmt.Errorf("unknown layout %q", opts.Layout)
+	}
+	if opts.RecordBuffer < 0 {
+		return nil, errors.New("record buffer must not be negative")
+	}
+	if opts.SourceIP != nil {
+		if err := checkSourceIP(opts.SourceIP); err != nil {
+			return nil, err
+		}
+		if opts.SourceIP.To4() != nil {
+			if opts.IPv6Only {
+				return nil, errors.New("IPv6 only requires an IPv6 source IP")
+			}
+			opts.IPv4Only = true
+		} else {
+			if opts.IPv4Only {
+				return nil, errors.New("IPv4 only requires an IPv4 source IP")
+			}
+			opts.IPv6Only = true
+		}
+	}
+	s := &Scanner{
+		opts:     opts,
+		port:     "53",
+		nxCache:  negativeCache{entries: make(map[string]time.Time)},
+		versions: make(map[string]string),
+		results:  newScanResults(),
+		log:      opts.Logger,
+	}
+	s.subzones.maxDepth = opts.SubzoneDepth
+	if s.log == nil {
+		s.log = logger.New(os.Stderr, false, opts.Verbosity)
+	}
+	s.client.Timeout = opts.Timeout
+	s.client.Dialer = &net.Dialer{
+		Timeout: opts.Timeout,
+	}
+	if opts.TCP {
+		s.client.Net = "tcp"
+	}
+	s.tcpClient = dns.Client{
+		Net:     "tcp",
+		Timeout: opts.Timeout,
+		Dialer: &net.Dialer{
+			Timeout: opts.Timeout,
+		},
+	}
+	if opts.SourceIP != nil {
+		s.tcpClient.Dialer.LocalAddr = &net.TCPAddr{IP: opts.SourceIP}
+		if opts.TCP {
+			s.client.Dialer.LocalAddr = &net.TCPAddr{IP: opts.SourceIP}
+		} else {
+			s.client.Dialer.LocalAddr = &net.UDPAddr{IP: opts.SourceIP}
+		}
+	}
+	if opts.ZoneRate > 0 {
+		s.zoneLimiter = rate.NewLimiter(rate.Limit(opts.ZoneRate), 1)
+	}
+	if opts.Cookies {
+		s.cookies = newCookieJar()
+	}
+	if opts.MaxOpenFiles == 0 {
+		s.fileLimit = save.NewFileLimit(save.DefaultFileLimit())
+	} else {
+		s.fileLimit = save.NewFileLimit(opts.MaxOpenFiles)
+	}
+	if opts.PerIP > 0 {
+		s.ipLimiter = newIPLimiter(opts.PerIP)
+	}
+	if opts.BandwidthLimit > 0 {
+		s.bwLimiter = rate.NewLimiter(rate.Limit(opts.BandwidthLimit), int(opts.BandwidthLimit))
+	}
+	return s, nil
+}
+
+// checkSourceIP returns an error if ip can not be used as a local address
+func checkSourceIP(ip net.IP) error {
+	c, err := net.ListenPacket("udp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return fmt.Errorf("unable to use source ip %s: %w", ip, err)
+	}
+	return c.Close()
+}
+
+// FileLimit returns the limit on open zone files shared by the Scanner's zone files, for use by sinks
+func (s *Scanner) FileLimit() *save.FileLimit {
+	return s.fileLimit
+}
+
+// Client returns the client used for DNS lookups
+func (s *Scanner) Client() *dns.Client {
+	return &s.client
+}
+
+// Run attempts to transfer every zone in z and returns the results
+// if ctx is canceled the transfers in progress are stopped and the results so far are returned without an error
+// each call returns only the results of its own transfers, and it must not be called again until it returns
+func (s *Scanner) Run(ctx context.Context, z zone.Zone) (Results, error) {
+	start := time.Now()
+	s.reset()
+	var names []string
+	if s.opts.Shuffle {
+		seed := s.opts.Seed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		s.log.Info(logger.Fields{}, "shuffling zones with seed %d", seed)
+		names = z.ShuffledNames(seed, s.opts.Interleave)
+	} else {
+		names = z.Names()
+	}
+	if s.opts.OnRecord != nil {
+		s.records = make(chan record, s.opts.RecordBuffer)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for r := range s.records {
+				s.opts.OnRecord(r.zone, r.rr)
+			}
+		}()
+		// every record is handed to OnRecord before returning
+		defer func() {
+			close(s.records)
+			<-done
+		}()
+	}
+	defer s.tcpPool.close()
+
+	g, gctx := errgroup.WithContext(ctx)
+	s.queue = newWorkQueue(gctx)
+	s.subzones.visit(z)
+	targets := make([]target, 0, len(names))
+	for _, domain := range names {
+		targets = append(targets, target{domain: domain, z: z})
+	}
+	s.queue.add(targets...)
+
+	// start workers
+	for i := uint(0); i < s.opts.Parallel; i++ {
+		g.Go(func() error { return s.worker(gctx) })
+	}
+
+	err := g.Wait()
+	results := s.results.summary(s, len(z.NS)+s.subzones.count(), time.Since(start).Round(time.Millisecond))
+	if ctx.Err() != nil {
+		results.StoppedEarly = ctx.Err().Error()
+	}
+	return results, err
+}
+
+// reset clears the results and counters of a previous Run
+func (s *Scanner) reset() {
+	s.results = newScanResults()
+	atomic.StoreUint64(&s.droppedRecords, 0)
+	atomic.StoreUint32(&s.totalXFR, 0)
+	atomic.StoreUint32(&s.totalExcludedZones, 0)
+	atomic.StoreUint32(&s.totalExcludedIPs, 0)
+	atomic.StoreUint32(&s.totalPrivateIPs, 0)
+	atomic.StoreUint32(&s.totalGlue, 0)
+	atomic.StoreUint32(&s.totalMissingGlue, 0)
+	atomic.StoreUint32(&s.totalZonesWithoutGlue, 0)
+}
+
+// worker attempts targets from the queue until it is finished
+func (s *Scanner) worker(ctx context.Context) error {
+	for {
+		t, ok := s.queue.next()
+		if !ok {
+			return nil
+		}
+		if s.zoneLimiter != nil {
+			// only fails when the context is done
+			if s.zoneLimiter.Wait(ctx) != nil {
+				s.queue.done()
+				return nil
+			}
+		}
+		err := s.zoneWorker(ctx, t)
+		s.queue.done()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// zoneWorker runs axfrWorker for t, abandoning it after ZoneTimeout if set
+func (s *Scanner) zoneWorker(ctx context.Context, t target) error {
+	if s.opts.ZoneTimeout <= 0 {
+		return s.axfrWorker(ctx, t)
+	}
+	zctx, cancel := context.WithTimeout(ctx, s.opts.ZoneTimeout)
+	defer cancel()
+	err := s.axfrWorker(zctx, t)
+	if ctx.Err() == nil && errors.Is(zctx.Err(), context.DeadlineExceeded) {
+		s.log.Info(logger.Fields{Zone: t.domain}, "zone timeout of %s reached, abandoning", s.opts.ZoneTimeout)
+		s.results.abandon(dns.Fqdn(t.domain), fmt.Errorf("zone timeout of %s reached", s.opts.ZoneTimeout))
+	}
+	return err
+}
+
+// record is a transferred record waiting for OnRecord
+type record struct {
+	zone string
+	rr   dns.RR
+}
+
+// onRecord passes rr to OnRecord if set, waiting for room in the buffer unless DropRecords is set
+func (s *Scanner) onRecord(ctx context.Context, zone string, rr dns.RR) {
+	if s.records == nil {
+		return
+	}
+	r := record{zone: zone, rr: rr}
+	if s.opts.DropRecords {
+		select {
+		case s.records <- r:
+		default:
+			atomic.AddUint64(&s.droppedRecords, 1)
+		}
+		return
+	}
+	select {
+	case s.records <- r:
+	case <-ctx.Done():
+	}
+}
+
+// totals returns the number of successful transfers and the zones and nameserver IPs skipped by Exclude
+func (s *Scanner) totals() (transferred, excludedZones, excludedIPs uint32) {
+	return atomic.LoadUint32(&s.totalXFR), atomic.LoadUint32(&s.totalExcludedZones), atomic.LoadUint32(&s.totalExcludedIPs)
+}
@@ -0,0 +1,344 @@
+package scan
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lanrat/allxfr/logger"
+	"github.com/lanrat/allxfr/zone"
+
+	"github.com/miekg/dns"
+)
+
+// testRecords are the records of example.com. served by testHandler in transfer order, starting and ending with its SOA
+var testRecords = []string{
+	"example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 7 3600 600 86400 300",
+	"example.com. 300 IN NS ns1.example.com.",
+	"ns1.example.com. 300 IN A 127.0.0.1",
+	"www.example.com. 300 IN A 192.0.2.1",
+	"example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 7 3600 600 86400 300",
+}
+
+// mustRRs parses each record in records, panicking on an invalid record as they are fixed test data
+func mustRRs(records []string) []dns.RR {
+	rrs := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			panic(err)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// testHandler serves example.com. over AXFR in two envelopes and refuses transfers of refused.example.
+// while still answering its SOA, transfers of truncated.example. are closed before the final SOA
+func testHandler() *dns.ServeMux {
+	mux := dns.NewServeMux()
+	mux.HandleFunc("example.com.", func(w dns.ResponseWriter, r *dns.Msg) {
+		serveTestZone(w, r, mustRRs(testRecords))
+	})
+	mux.HandleFunc("truncated.example.", func(w dns.ResponseWriter, r *dns.Msg) {
+		rrs := renameRRs(mustRRs(testRecords), "truncated.example.")
+		serveTestZone(w, r, rrs[:len(rrs)-1])
+		w.Close()
+	})
+	mux.HandleFunc("refused.example.", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		if r.Question[0].Qtype == dns.TypeAXFR {
+			m.SetRcode(r, dns.RcodeRefused)
+			w.WriteMsg(m)
+			return
+		}
+		m.SetReply(r)
+		m.Authoritative = true
+		if r.Question[0].Qtype == dns.TypeSOA {
+			m.Answer = mustRRs([]string{"refused.example. 300 IN SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300"})
+		}
+		w.WriteMsg(m)
+	})
+	return mux
+}
+
+// renameRRs moves rrs from example.com. to zone
+func renameRRs(rrs []dns.RR, zone string) []dns.RR {
+	for _, rr := range rrs {
+		rr.Header().Name = strings.Replace(rr.Header().Name, "example.com.", zone, 1)
+	}
+	return rrs
+}
+
+// serveTestZone answers a transfer request with rrs in two envelopes and any other query for the zone with its SOA
+func serveTestZone(w dns.ResponseWriter, r *dns.Msg, rrs []dns.RR) {
+	if r.Question[0].Qtype != dns.TypeAXFR {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		if r.Question[0].Qtype == dns.TypeSOA {
+			m.Answer = rrs[:1]
+		}
+		w.WriteMsg(m)
+		return
+	}
+	env := make(chan *dns.Envelope, 2)
+	env <- &dns.Envelope{RR: rrs[:2]}
+	env <- &dns.Envelope{RR: rrs[2:]}
+	close(env)
+	tr := new(dns.Transfer)
+	tr.Out(w, r, env)
+}
+
+// startServer serves handler over UDP and TCP on the same port of every one of ips and returns the port
+// the servers are shut down when the test finishes
+func startServer(t *testing.T, handler dns.Handler, ips ...string) string {
+	t.Helper()
+	var lastErr error
+	// the first listener picks a free port, which may already be taken on the other addresses
+	for try := 0; try < 10; try++ {
+		port, servers, err := listenServers(handler, ips)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, srv := range servers {
+			started := make(chan struct{})
+			srv.NotifyStartedFunc = func() { close(started) }
+			go srv.ActivateAndServe()
+			<-started
+			t.Cleanup(func() { srv.Shutdown() })
+		}
+		return port
+	}
+	t.Fatalf("unable to start test server: %s", lastErr)
+	return ""
+}
+
+// listenServers opens a UDP and TCP listener for each of ips on a single free port
+func listenServers(handler dns.Handler, ips []string) (string, []*dns.Server, error) {
+	port := "0"
+	var servers []*dns.Server
+	closeAll := func() {
+		for _, srv := range servers {
+			if srv.PacketConn != nil {
+				srv.PacketConn.Close()
+			}
+			if srv.Listener != nil {
+				srv.Listener.Close()
+			}
+		}
+	}
+	for _, ip := range ips {
+		pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+		if err != nil {
+			closeAll()
+			return "", nil, err
+		}
+		_, port, _ = net.SplitHostPort(pc.LocalAddr().String())
+		servers = append(servers, &dns.Server{PacketConn: pc, Handler: handler})
+		l, err := net.Listen("tcp", net.JoinHostPort(ip, port))
+		if err != nil {
+			closeAll()
+			return "", nil, err
+		}
+		servers = append(servers, &dns.Server{Listener: l, Handler: handler})
+	}
+	return port, servers, nil
+}
+
+// newTestScanner returns a Scanner for opts that sends every query and transfer to port
+func newTestScanner(t *testing.T, opts Options, port string) *Scanner {
+	t.Helper()
+	opts.Parallel = 1
+	opts.Retry = 1
+	opts.Timeout = 2 * time.Second
+	opts.Nameserver = net.JoinHostPort("127.0.0.1", port)
+	opts.AllowPrivate = true
+	opts.Uncompressed = true
+	opts.Logger = logger.New(io.Discard, false, 0)
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.port = port
+	return s
+}
+
+// testZone returns the zones example.com. and refused.example. served by nameservers at ips
+func testZone(ips ...string) zone.Zone {
+	var z zone.Zone
+	for i, ip := range ips {
+		nameserver := "ns" + string(rune('1'+i)) + ".example.com."
+		z.AddNS("example.com.", nameserver)
+		z.AddNS("refused.example.", nameserver)
+		z.AddIP(nameserver, net.ParseIP(ip))
+	}
+	return z
+}
+
+func TestRun(t *testing.T) {
+	port := startServer(t, testHandler(), "127.0.0.1")
+	dir := t.TempDir()
+	s := newTestScanner(t, Options{SaveDir: dir}, port)
+	results, err := s.Run(context.Background(), testZone("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Attempted != 2 || results.ZonesTransferred != 1 {
+		t.Fatalf("got %d attempted and %d transferred zones, want 2 and 1", results.Attempted, results.ZonesTransferred)
+	}
+	if len(results.Transfers) != 1 || results.Transfers[0].Zone != "example.com." || results.Transfers[0].Records != int64(len(testRecords)) {
+		t.Fatalf("got transfers %+v, want %d records of example.com.", results.Transfers, len(testRecords))
+	}
+	if len(results.Failures) != 1 || results.Failures[0].Zone != "refused.example." {
+		t.Fatalf("got failures %+v, want refused.example.", results.Failures)
+	}
+	reason := results.Failures[0].Reasons["ns1.example.com. 127.0.0.1"]
+	if !strings.HasPrefix(reason, "refused-but-soa-ok: ") {
+		t.Errorf("got failure reason %q, want refused-but-soa-ok", reason)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "example.com.zone" {
+		t.Fatalf("got files %v, want example.com.zone", entries)
+	}
+	rrs, err := zone.ReadRecords(path.Join(dir, "example.com.zone"), "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != len(testRecords) {
+		t.Errorf("saved %d records, want %d", len(rrs), len(testRecords))
+	}
+	keys, err := zone.ReadCommentKeys(path.Join(dir, "example.com.zone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := keys["incomplete"]; ok {
+		t.Error("complete transfer saved as incomplete")
+	}
+}
+
+func TestRunTwice(t *testing.T) {
+	port := startServer(t, testHandler(), "127.0.0.1")
+	s := newTestScanner(t, Options{SaveDir: t.TempDir(), Overwrite: true}, port)
+	for run := 1; run <= 2; run++ {
+		results, err := s.Run(context.Background(), testZone("127.0.0.1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if results.Attempted != 2 || results.Transferred != 1 || len(results.Transfers) != 1 || len(results.Failures) != 1 || results.GlueNameservers != 2 {
+			t.Errorf("run %d got %d attempted, %d transferred, transfers %+v, failures %+v and %d glue nameservers, want only the results of one run",
+				run, results.Attempted, results.Transferred, results.Transfers, results.Failures, results.GlueNameservers)
+		}
+	}
+}
+
+func TestRunZoneTimeout(t *testing.T) {
+	mux := testHandler()
+	// answers transfers only after the zone timeout
+	release := make(chan struct{})
+	mux.HandleFunc("slow.example.", func(w dns.ResponseWriter, r *dns.Msg) {
+		select {
+		case <-release:
+		case <-time.After(time.Second):
+		}
+		serveTestZone(w, r, renameRRs(mustRRs(testRecords), "slow.example."))
+	})
+	port := startServer(t, mux, "127.0.0.1")
+	// registered after the server so it runs first
+	t.Cleanup(func() { close(release) })
+	s := newTestScanner(t, Options{SaveDir: t.TempDir(), ZoneTimeout: 100 * time.Millisecond}, port)
+	var z zone.Zone
+	z.AddNS("slow.example.", "ns1.example.com.")
+	z.AddIP("ns1.example.com.", net.ParseIP("127.0.0.1"))
+	results, err := s.Run(context.Background(), z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Transfers) != 0 || len(results.Failures) != 1 || results.Failures[0].Zone != "slow.example." {
+		t.Fatalf("got transfers %+v and failures %+v, want slow.example. failed", results.Transfers, results.Failures)
+	}
+	if reason := results.Failures[0].Reasons[abandonedKey]; reason != "zone timeout of 100ms reached" {
+		t.Errorf("got reasons %v, want the zone timeout", results.Failures[0].Reasons)
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	port := startServer(t, testHandler(), "127.0.0.1")
+	dir := t.TempDir()
+	s := newTestScanner(t, Options{SaveDir: dir, DryRun: true}, port)
+	results, err := s.Run(context.Background(), testZone("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ProbeResult{
+		{Zone: "example.com.", Nameserver: "ns1.example.com.", IP: "127.0.0.1", Result: ProbeAllowed, Records: 2},
+		{Zone: "refused.example.", Nameserver: "ns1.example.com.", IP: "127.0.0.1", Result: ProbeRefused, Rcode: "REFUSED"},
+	}
+	if len(results.Probes) != len(want) {
+		t.Fatalf("got probes %+v, want %+v", results.Probes, want)
+	}
+	for i := range want {
+		if results.Probes[i] != want[i] {
+			t.Errorf("got probe %+v, want %+v", results.Probes[i], want[i])
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("dry run saved files %v", entries)
+	}
+}
+
+func TestRunSaveAll(t *testing.T) {
+	port := startServer(t, testHandler(), "127.0.0.1", "127.0.0.2")
+	dir := t.TempDir()
+	s := newTestScanner(t, Options{SaveDir: dir, SaveAll: true}, port)
+	results, err := s.Run(context.Background(), testZone("127.0.0.1", "127.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Transfers) != 2 {
+		t.Fatalf("got transfers %+v, want one from each nameserver", results.Transfers)
+	}
+	for _, target := range []struct{ nameserver, ip string }{
+		{"ns1.example.com.", "127.0.0.1"},
+		{"ns2.example.com.", "127.0.0.2"},
+	} {
+		filename := path.Join(dir, s.ZonePath("example.com.", target.nameserver, net.ParseIP(target.ip)))
+		rrs, err := zone.ReadRecords(filename, "example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rrs) != len(testRecords) {
+			t.Errorf("saved %d records to %s, want %d", len(rrs), filename, len(testRecords))
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("got files %v, want one for each nameserver", entries)
+	}
+}
+
+func TestNewGzipLevel(t *testing.T) {
+	for level, ok := range map[int]bool{-1: false, 0: true, 1: true, 9: true, 10: false} {
+		_, err := New(Options{Parallel: 1, Retry: 1, Timeout: time.Second, Nameserver: "127.0.0.1:53", GzipLevel: level})
+		if (err == nil) != ok {
+			t.Errorf("New with gzip level %d returned error %v", level, err)
+		}
+	}
+}
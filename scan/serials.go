@@ -0,0 +1,102 @@
+package scan
+
+import (
+	"context"
+	"net"
+	"sort"
+
+	"github.com/lanrat/allxfr/logger"
+	"github.com/lanrat/allxfr/zone"
+)
+
+// NameserverSerial is the SOA serial reported by a single nameserver IP
+type NameserverSerial struct {
+	Nameserver string `json:"nameserver"`
+	IP         string `json:"ip"`
+	Serial     uint32 `json:"serial,omitempty"`
+	// Error is why the serial could not be queried
+	Error string `json:"error,omitempty"`
+}
+
+// ZoneSerials are the SOA serials reported by every nameserver IP of a transferred zone for Serials
+type ZoneSerials struct {
+	Zone    string             `json:"zone"`
+	Servers []NameserverSerial `json:"servers"`
+	// Divergent is true if the nameservers did not all report the same serial
+	Divergent bool `json:"divergent"`
+}
+
+// addSerials records the serials of a zone
+func (r *scanResults) addSerials(serials ZoneSerials) {
+	r.Lock()
+	defer r.Unlock()
+	r.serials = append(r.serials, serials)
+}
+
+// checkSerials queries every nameserver IP of domain for its SOA serial and records them, warning if they differ
+func (s *Scanner) checkSerials(ctx context.Context, z zone.Zone, domain string) {
+	targets := make([]raceTarget, 0)
+	seen := make(map[string]bool)
+	add := func(nameserver string, ips []net.IP) {
+		for _, ip := range ips {
+			key := string(ip.To16())
+			if seen[key] || !s.IPAllowed(ip) || s.opts.Exclude.ip(ip) || (!s.opts.AllowPrivate && privateIP(ip)) {
+				continue
+			}
+			seen[key] = true
+			targets = append(targets, raceTarget{nameserver: nameserver, ip: ip})
+		}
+	}
+	for _, nameserver := range z.NS[domain] {
+		add(nameserver, z.IP[nameserver])
+	}
+	if s.opts.QueryNameservers {
+		nameservers, err := s.LookupNS(domain)
+		if err != nil {
+			s.log.Debug(logger.Fields{Zone: domain}, "%s", err)
+		}
+		for _, nameserver := range nameservers {
+			ips, err := s.LookupIP(nameserver)
+			if err != nil {
+				s.log.Debug(logger.Fields{Zone: domain}, "%s", err)
+			}
+			add(nameserver, ips)
+		}
+	}
+
+	serials := ZoneSerials{Zone: domain, Servers: make([]NameserverSerial, 0, len(targets))}
+	values := make(map[uint32]bool)
+	for _, target := range targets {
+		if ctx.Err() != nil {
+			return
+		}
+		result := NameserverSerial{Nameserver: target.nameserver, IP: target.ip.String()}
+		serial, err := s.querySerial(net.JoinHostPort(target.ip.String(), s.port), domain)
+		if err != nil {
+			s.log.Debug(logger.Fields{Zone: domain, Nameserver: target.nameserver, IP: target.ip}, "unable to query serial: %s", err)
+			result.Error = err.Error()
+		} else {
+			result.Serial = serial
+			values[serial] = true
+		}
+		serials.Servers = append(serials.Servers, result)
+	}
+	serials.Divergent = len(values) > 1
+	if serials.Divergent {
+		s.log.Warn(logger.Fields{Zone: domain}, "nameservers report %d different SOA serials", len(values))
+	}
+	s.results.addSerials(serials)
+}
+
+// sortSerials sorts by zone and the servers of each zone by nameserver and then IP
+func sortSerials(serials []ZoneSerials) {
+	sort.Slice(serials, func(i, j int) bool { return serials[i].Zone < serials[j].Zone })
+	for _, z := range serials {
+		sort.Slice(z.Servers, func(i, j int) bool {
+			if z.Servers[i].Nameserver != z.Servers[j].Nameserver {
+				return z.Servers[i].Nameserver < z.Servers[j].Nameserver
+			}
+			return z.Servers[i].IP < z.Servers[j].IP
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package scan
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/lanrat/allxfr/logger"
+	"github.com/lanrat/allxfr/zone"
+
+	"github.com/miekg/dns"
+)
+
+// subzoneSet tracks the zones delegated from transferred zones for SubzoneDepth
+type subzoneSet struct {
+	sync.Mutex
+	// maxDepth is SubzoneDepth
+	maxDepth int
+	// map of every zone attempted or found to how many levels below the starting zones it was found
+	// so a delegation loop is only followed once
+	depth map[string]int
+	// addresses of the nameservers of the starting zones and every subzone found, from the glue in their parent zones
+	// only addresses of nameservers inside the parent zone are kept, as a zone can not be trusted for names outside it
+	glue map[string][]net.IP
+	// total number of subzones found
+	found int
+}
+
+// visit records the zones in z as the starting zones so they are not found again as subzones
+// and keeps the addresses of their nameservers for subzones that use the same nameservers
+// the subzones found by a previous Run are forgotten
+func (set *subzoneSet) visit(z zone.Zone) {
+	set.Lock()
+	defer set.Unlock()
+	set.found = 0
+	if set.maxDepth == 0 {
+		return
+	}
+	set.depth = make(map[string]int, len(z.NS))
+	set.glue = make(map[string][]net.IP, len(z.IP))
+	for domain := range z.NS {
+		set.depth[domain] = 0
+	}
+	for nameserver, ips := range z.IP {
+		set.glue[nameserver] = ips
+	}
+}
+
+// collector returns the zone to add the delegations and glue of a transfer of domain to,
+// or nil if subzones of domain would be too deep to attempt
+func (set *subzoneSet) collector(domain string) *zone.Zone {
+	if set.maxDepth == 0 {
+		return nil
+	}
+	set.Lock()
+	defer set.Unlock()
+	depth, ok := set.depth[strings.ToLower(domain)]
+	if !ok || depth >= set.maxDepth {
+		return nil
+	}
+	return new(zone.Zone)
+}
+
+// add returns a target for each delegation in found that has not been seen before, found in a transfer of parent
+func (set *subzoneSet) add(parent string, found zone.Zone) []target {
+	set.Lock()
+	defer set.Unlock()
+	depth := set.depth[strings.ToLower(parent)] + 1
+	var targets []target
+	for domain, nameservers := range found.NS {
+		if _, ok := set.depth[domain]; ok {
+			continue
+		}
+		set.depth[domain] = depth
+		var sub zone.Zone
+		// subzones are always attempted, even under arpa
+		sub.AddTarget(domain)
+		resolve := false
+		for _, nameserver := range nameservers {
+			sub.AddNS(domain, nameserver)
+			var ips []net.IP
+			if dns.IsSubDomain(parent, nameserver) {
+				ips = found.IP[nameserver]
+			}
+			if len(ips) > 0 {
+				set.glue[nameserver] = ips
+			} else {
+				// nested subzones often use the nameservers of a zone further up that had the glue
+				ips = set.glue[nameserver]
+			}
+			for _, ip := range ips {
+				sub.AddIP(nameserver, ip)
+			}
+			if len(ips) == 0 {
+				resolve = true
+			}
+		}
+		targets = append(targets, target{domain: domain, z: sub, resolve: resolve})
+	}
+	set.found += len(targets)
+	return targets
+}
+
+// count returns the number of subzones found
+func (set *subzoneSet) count() int {
+	set.Lock()
+	defer set.Unlock()
+	return set.found
+}
+
+// discoverSubzone adds rr to found if it is a delegation below zone or a possible glue address inside zone
+func discoverSubzone(found *zone.Zone, zone string, rr dns.RR) {
+	switch t := rr.(type) {
+	case *dns.NS:
+		if !strings.EqualFold(t.Hdr.Name, zone) && dns.IsSubDomain(zone, t.Hdr.Name) {
+			found.AddNS(t.Hdr.Name, t.Ns)
+		}
+	case *dns.A, *dns.AAAA:
+		if dns.IsSubDomain(zone, rr.Header().Name) {
+			found.AddRecord(rr)
+		}
+	}
+}
+
+// resolveNameservers looks up the addresses of the nameservers of domain that have none in z
+// these are the nameservers of subzones outside their parent zone, which have no glue that can be trusted
+func (s *Scanner) resolveNameservers(z *zone.Zone, domain string) {
+	for _, nameserver := range z.NS[domain] {
+		if len(z.IP[nameserver]) > 0 {
+			continue
+		}
+		ips, err := s.LookupIP(nameserver)
+		if err != nil {
+			s.log.Debug(logger.Fields{Zone: domain, Nameserver: nameserver}, "%s", err)
+			continue
+		}
+		for _, ip := range ips {
+			z.AddIP(nameserver, ip)
+		}
+	}
+}
+
+// addSubzones queues the subzones found in a transfer of zone
+func (s *Scanner) addSubzones(zone string, found zone.Zone) {
+	targets := s.subzones.add(zone, found)
+	if len(targets) == 0 {
+		return
+	}
+	s.log.Debug(logger.Fields{Zone: zone}, "found %d new subzones", len(targets))
+	s.queue.add(targets...)
+}
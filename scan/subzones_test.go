@@ -0,0 +1,102 @@
+package scan
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/lanrat/allxfr/zone"
+
+	"github.com/miekg/dns"
+)
+
+func TestSubzoneGlue(t *testing.T) {
+	var start zone.Zone
+	start.AddNS("example.com.", "ns1.example.com.")
+	set := subzoneSet{maxDepth: 1}
+	set.visit(start)
+	found := set.collector("example.com.")
+	if found == nil {
+		t.Fatal("no collector for a starting zone")
+	}
+	for _, rr := range mustRRs([]string{
+		"example.com. 300 IN NS ns1.example.com.",
+		"in.example.com. 300 IN NS ns1.in.example.com.",
+		"ns1.in.example.com. 300 IN A 192.0.2.1",
+		"out.example.com. 300 IN NS ns.other.example.",
+		// out of bailiwick, the zone can not say where ns.other.example. is
+		"ns.other.example. 300 IN A 192.0.2.66",
+	}) {
+		discoverSubzone(found, "example.com.", rr)
+	}
+
+	targets := set.add("example.com.", *found)
+	slices.SortFunc(targets, func(a, b target) int { return strings.Compare(a.domain, b.domain) })
+	if len(targets) != 2 || targets[0].domain != "in.example.com." || targets[1].domain != "out.example.com." {
+		t.Fatalf("got targets %+v, want in.example.com. and out.example.com.", targets)
+	}
+	in := targets[0]
+	if in.resolve || !slices.EqualFunc(in.z.IP["ns1.in.example.com."], []net.IP{net.ParseIP("192.0.2.1")}, net.IP.Equal) {
+		t.Errorf("got addresses %v and resolve %t for in.example.com., want its glue", in.z.IP, in.resolve)
+	}
+	out := targets[1]
+	if !out.resolve || len(out.z.IP["ns.other.example."]) != 0 {
+		t.Errorf("got addresses %v and resolve %t for out.example.com., want it resolved", out.z.IP, out.resolve)
+	}
+}
+
+func TestRunSubzones(t *testing.T) {
+	mux := testHandler()
+	mux.HandleFunc("example.com.", func(w dns.ResponseWriter, r *dns.Msg) {
+		serveTestZone(w, r, mustRRs([]string{
+			"example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 7 3600 600 86400 300",
+			"example.com. 300 IN NS ns1.example.com.",
+			"in.example.com. 300 IN NS ns1.in.example.com.",
+			"ns1.in.example.com. 300 IN A 127.0.0.1",
+			"out.example.com. 300 IN NS ns.other.example.",
+			// ignored as glue, the resolver has the real address
+			"ns.other.example. 300 IN A 127.0.0.2",
+			"example.com. 300 IN SOA ns1.example.com. hostmaster.example.com. 7 3600 600 86400 300",
+		}))
+	})
+	for _, subzone := range []string{"in.example.com.", "out.example.com."} {
+		rrs := mustRRs([]string{
+			subzone + " 300 IN SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300",
+			subzone + " 300 IN NS ns1.example.com.",
+			subzone + " 300 IN SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300",
+		})
+		mux.HandleFunc(subzone, func(w dns.ResponseWriter, r *dns.Msg) {
+			serveTestZone(w, r, rrs)
+		})
+	}
+	mux.HandleFunc("ns.other.example.", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeA {
+			m.Answer = mustRRs([]string{"ns.other.example. 300 IN A 127.0.0.1"})
+		}
+		w.WriteMsg(m)
+	})
+	port := startServer(t, mux, "127.0.0.1")
+	s := newTestScanner(t, Options{SaveDir: t.TempDir(), SubzoneDepth: 1}, port)
+	var z zone.Zone
+	z.AddNS("example.com.", "ns1.example.com.")
+	z.AddIP("ns1.example.com.", net.ParseIP("127.0.0.1"))
+	results, err := s.Run(context.Background(), z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Subzones != 2 || len(results.Failures) != 0 {
+		t.Errorf("got %d subzones and failures %+v, want 2 subzones and no failures", results.Subzones, results.Failures)
+	}
+	var got []string
+	for _, transfer := range results.Transfers {
+		got = append(got, transfer.Zone+" "+transfer.IP)
+	}
+	want := []string{"example.com. 127.0.0.1", "in.example.com. 127.0.0.1", "out.example.com. 127.0.0.1"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got transfers %v, want %v", got, want)
+	}
+}
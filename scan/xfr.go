@@ -0,0 +1,168 @@
+package scan
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rcodeError is an error rcode sent in reply to a transfer request
+type rcodeError int
+
+func (e rcodeError) Error() string {
+	return fmt.Sprintf("bad xfr rcode: %s", rcodeName(int(e)))
+}
+
+// rcodeName returns the name of rcode, or RCODE followed by its number if it has none
+func rcodeName(rcode int) string {
+	if name, ok := dns.RcodeToString[rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("RCODE%d", rcode)
+}
+
+// transferIn sends the AXFR or IXFR request q on conn and returns the envelopes of its reply
+// the first reply is read before returning so that a transfer refused with an error rcode returns an rcodeError
+// each read times out after timeout, and conn is closed once the last envelope is sent
+func transferIn(conn *dns.Conn, q *dns.Msg, timeout time.Duration) (chan *dns.Envelope, error) {
+	err := conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	err = conn.WriteMsg(q)
+	if err != nil {
+		return nil, err
+	}
+	first, err := readReply(conn, q, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if first.Rcode != dns.RcodeSuccess {
+		return nil, rcodeError(first.Rcode)
+	}
+	env := make(chan *dns.Envelope)
+	go func() {
+		// the connection is closed before the channel so readers of the channel know it is no longer in use
+		defer func() {
+			conn.Close()
+			close(env)
+		}()
+		if q.Question[0].Qtype == dns.TypeIXFR {
+			readIxfr(conn, q, first, timeout, env)
+		} else {
+			readAxfr(conn, q, first, timeout, env)
+		}
+	}()
+	return env, nil
+}
+
+// readReply reads the next message of the reply to q from conn
+func readReply(conn *dns.Conn, q *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	err := conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	in, err := conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if in.Id != q.Id {
+		return in, dns.ErrId
+	}
+	return in, nil
+}
+
+// readAxfr sends the answers of an AXFR reply starting with first to env until the closing SOA
+func readAxfr(conn *dns.Conn, q *dns.Msg, first *dns.Msg, timeout time.Duration, env chan *dns.Envelope) {
+	if !soaFirst(first) {
+		env <- &dns.Envelope{RR: first.Answer, Error: dns.ErrSoa}
+		return
+	}
+	in := first
+	for {
+		env <- &dns.Envelope{RR: in.Answer}
+		// a first message with only the SOA is followed by the rest of the zone
+		if soaLast(in) && (in != first || len(in.Answer) > 1) {
+			return
+		}
+		var err error
+		in, err = readReply(conn, q, timeout)
+		if err != nil {
+			var rr []dns.RR
+			if in != nil {
+				rr = in.Answer
+			}
+			env <- &dns.Envelope{RR: rr, Error: err}
+			return
+		}
+		if in.Rcode != dns.RcodeSuccess {
+			env <- &dns.Envelope{RR: in.Answer, Error: rcodeError(in.Rcode)}
+			return
+		}
+	}
+}
+
+// readIxfr sends the answers of an IXFR reply starting with first to env until the servers current SOA closes it
+// a server may reply with a full AXFR instead
+func readIxfr(conn *dns.Conn, q *dns.Msg, first *dns.Msg, timeout time.Duration, env chan *dns.Envelope) {
+	if !soaFirst(first) {
+		env <- &dns.Envelope{RR: first.Answer, Error: dns.ErrSoa}
+		return
+	}
+	// the first serial is the current serial of the server
+	serial := first.Answer[0].(*dns.SOA).Serial
+	if len(q.Ns) > 0 {
+		if base, ok := q.Ns[0].(*dns.SOA); ok && base.Serial >= serial {
+			// there are no changes
+			env <- &dns.Envelope{RR: first.Answer}
+			return
+		}
+	}
+	axfr := true
+	n := 0
+	in := first
+	for {
+		for _, rr := range in.Answer {
+			soa, ok := rr.(*dns.SOA)
+			if !ok {
+				continue
+			}
+			if soa.Serial != serial {
+				axfr = false
+				continue
+			}
+			n++
+			// a full AXFR ends with the second current SOA, an IXFR with the third
+			if (axfr && n == 2) || n == 3 {
+				env <- &dns.Envelope{RR: in.Answer}
+				return
+			}
+		}
+		env <- &dns.Envelope{RR: in.Answer}
+		var err error
+		in, err = readReply(conn, q, timeout)
+		if err != nil {
+			var rr []dns.RR
+			if in != nil {
+				rr = in.Answer
+			}
+			env <- &dns.Envelope{RR: rr, Error: err}
+			return
+		}
+		if in.Rcode != dns.RcodeSuccess {
+			env <- &dns.Envelope{RR: in.Answer, Error: rcodeError(in.Rcode)}
+			return
+		}
+	}
+}
+
+// soaFirst returns true if the answer of in starts with an SOA
+func soaFirst(in *dns.Msg) bool {
+	return len(in.Answer) > 0 && in.Answer[0].Header().Rrtype == dns.TypeSOA
+}
+
+// soaLast returns true if the answer of in ends with an SOA
+func soaLast(in *dns.Msg) bool {
+	return len(in.Answer) > 0 && in.Answer[len(in.Answer)-1].Header().Rrtype == dns.TypeSOA
+}
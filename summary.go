@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/lanrat/allxfr/logger"
+	"github.com/lanrat/allxfr/scan"
+)
+
+// printAllowed prints a table of the -dry-run attempts that allowed a transfer to stdout
+func printAllowed(probes []scan.ProbeResult) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ZONE\tNAMESERVER\tIP\tRECORDS")
+	for _, p := range probes {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", displayName(p.Zone), p.Nameserver, p.IP, p.Records)
+	}
+	return w.Flush()
+}
+
+// displayName returns name followed by its Unicode form if it is an internationalized name from the command line
+func displayName(name string) string {
+	if unicode, ok := unicodeNames[name]; ok {
+		return name + " " + unicode
+	}
+	return name
+}
+
+// summary is the scan summary written to -summary
+type summary struct {
+	scan.Results
+	// Unicode maps the ASCII form of internationalized names given on the command line to their Unicode form
+	Unicode map[string]string `json:"unicode,omitempty"`
+}
+
+// writeSummary atomically writes the scan summary as JSON to filename
+func writeSummary(filename string, s summary) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	encoder := json.NewEncoder(tmp)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(s)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// leaksFile appends a line for each successful transfer to a file as soon as it finishes
+type leaksFile struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openLeaksFile opens filename for appending, creating it if needed
+func openLeaksFile(filename string) (*leaksFile, error) {
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &leaksFile{file: file}, nil
+}
+
+// add writes the zone, nameserver, IP and records of t as a single line, followed by the Unicode form of the zone
+// if it is internationalized, lines are written without buffering so they are kept if the scan is killed
+func (l *leaksFile) add(t scan.TransferResult) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	line := fmt.Sprintf("%s %s %s %d", t.Zone, t.Nameserver, t.IP, t.Records)
+	if unicode, ok := unicodeNames[t.Zone]; ok {
+		line += " " + unicode
+	}
+	_, err := fmt.Fprintln(l.file, line)
+	if err != nil {
+		logs.Warn(logger.Fields{Zone: t.Zone}, "unable to write to leaks file: %s", err)
+	}
+}
+
+// Close closes the file
+func (l *leaksFile) Close() error {
+	return l.file.Close()
+}
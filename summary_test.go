@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+func TestDisplayName(t *testing.T) {
+	unicodeNames["xn--bcher-kva.example."] = "bücher.example."
+	defer delete(unicodeNames, "xn--bcher-kva.example.")
+	if got := displayName("xn--bcher-kva.example."); got != "xn--bcher-kva.example. bücher.example." {
+		t.Errorf("got %q for an internationalized zone", got)
+	}
+	if got := displayName("example.com."); got != "example.com." {
+		t.Errorf("got %q for an ASCII zone", got)
+	}
+}
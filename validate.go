@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lanrat/allxfr/zone"
+	"github.com/miekg/dns"
+)
+
+// validateZoneFiles re-parses saved zone files and prints a PASS or FAIL line for each to stdout
+// returns true if every file passed
+func validateZoneFiles(filenames []string) bool {
+	ok := true
+	for _, filename := range filenames {
+		problems := validateZoneFile(filename)
+		if len(problems) > 0 {
+			ok = false
+			fmt.Printf("FAIL %s: %s\n", filename, strings.Join(problems, ", "))
+			continue
+		}
+		fmt.Printf("PASS %s\n", filename)
+	}
+	return ok
+}
+
+// validateZoneFile returns the problems found in a zone file saved by allxfr
+func validateZoneFile(filename string) []string {
+	keys, err := zone.ReadCommentKeys(filename)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if _, ok := keys["diff_base"]; ok {
+		return []string{"diff files can not be validated"}
+	}
+	origin := zone.OriginFromFilename(filename)
+	if z, ok := keys["zone"]; ok {
+		origin = z
+	}
+	origin = dns.Fqdn(strings.ToLower(origin))
+	rrs, err := zone.ReadRecords(filename, origin)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var problems []string
+	if _, ok := keys["incomplete"]; ok {
+		problems = append(problems, "incomplete transfer")
+	}
+	if reason, ok := keys["error"]; ok {
+		problems = append(problems, fmt.Sprintf("partial transfer: %s", reason))
+	}
+	var first *dns.SOA
+	if len(rrs) == 0 {
+		problems = append(problems, "no records")
+	} else if soa, ok := rrs[0].(*dns.SOA); !ok || !strings.EqualFold(soa.Hdr.Name, origin) {
+		problems = append(problems, fmt.Sprintf("does not start with SOA for %s", origin))
+	} else {
+		first = soa
+	}
+
+	// an AXFR repeats the SOA at the end, an IXFR has an SOA for every version
+	axfr := !strings.HasPrefix(keys["xfr"], "IXFR")
+	closing := false
+	soas, outOfZone := 0, 0
+	for i, rr := range rrs {
+		if !dns.IsSubDomain(origin, rr.Header().Name) {
+			outOfZone++
+		}
+		t, ok := rr.(*dns.SOA)
+		if !ok || !axfr || i == 0 || first == nil {
+			continue
+		}
+		if !dns.IsDuplicate(first, t) {
+			soas++
+		} else if i == len(rrs)-1 || keys["sorted"] == "true" {
+			// sorting moves the closing SOA next to the starting one
+			closing = true
+		}
+	}
+	if soas > 0 {
+		problems = append(problems, fmt.Sprintf("%d extra SOA records", soas))
+	}
+	if axfr && first != nil && !closing {
+		problems = append(problems, "does not end with the starting SOA")
+	}
+	if outOfZone > 0 {
+		problems = append(problems, fmt.Sprintf("%d out of bailiwick records", outOfZone))
+	}
+
+	records, ok := keys["records"]
+	if !ok {
+		problems = append(problems, "no records comment")
+	} else if n, err := strconv.Atoi(records); err != nil || n != len(rrs) {
+		problems = append(problems, fmt.Sprintf("records comment %s does not match %d records", records, len(rrs)))
+	}
+	return problems
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateZoneFile(t *testing.T) {
+	const (
+		soa    = "example.com.\t300\tIN\tSOA\tns1.example.com. hostmaster.example.com. 7 3600 600 86400 300\n"
+		ns     = "example.com.\t300\tIN\tNS\tns1.example.com.\n"
+		a      = "www.example.com.\t300\tIN\tA\t192.0.2.1\n"
+		oldSOA = "example.com.\t300\tIN\tSOA\tns1.example.com. hostmaster.example.com. 6 3600 600 86400 300\n"
+	)
+	tests := []struct {
+		name     string
+		contents string
+		// problem is a substring of the problems found, empty if the file should pass
+		problem string
+	}{
+		{name: "complete", contents: "; xfr: AXFR\n" + soa + ns + a + soa + "; records: 4\n"},
+		{name: "sorted", contents: "; xfr: AXFR\n" + soa + ns + soa + a + "; sorted: true\n; records: 4\n"},
+		{name: "ixfr", contents: "; xfr: IXFR\n" + soa + oldSOA + soa + a + "; records: 4\n"},
+		{name: "no closing soa", contents: "; xfr: AXFR\n" + soa + ns + a + "; records: 3\n", problem: "does not end with the starting SOA"},
+		{name: "closing soa not last", contents: "; xfr: AXFR\n" + soa + ns + soa + a + "; records: 4\n", problem: "does not end with the starting SOA"},
+		{name: "different soa", contents: "; xfr: AXFR\n" + soa + ns + a + oldSOA + "; records: 4\n", problem: "1 extra SOA records"},
+		{name: "incomplete", contents: "; xfr: AXFR\n" + soa + ns + a + "; incomplete: true\n; records: 3\n", problem: "incomplete transfer"},
+		{name: "partial", contents: "; xfr: AXFR\n" + soa + ns + "; error: exceeded limit\n; records: 2\n", problem: "partial transfer: exceeded limit"},
+		{name: "no soa", contents: "; xfr: AXFR\n" + ns + a + "; records: 2\n", problem: "does not start with SOA for example.com."},
+		{name: "records mismatch", contents: "; xfr: AXFR\n" + soa + ns + a + soa + "; records: 5\n", problem: "records comment 5 does not match 4 records"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "example.com.zone")
+			err := os.WriteFile(filename, []byte(test.contents), 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			problems := strings.Join(validateZoneFile(filename), ", ")
+			if len(test.problem) == 0 && len(problems) > 0 {
+				t.Errorf("got problems %q, want none", problems)
+			}
+			if !strings.Contains(problems, test.problem) {
+				t.Errorf("got problems %q, want %q", problems, test.problem)
+			}
+		})
+	}
+}
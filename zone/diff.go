@@ -0,0 +1,29 @@
+package zone
+
+import (
+	"sort"
+)
+
+// Diff compares two record sets in the same text form, such as from save.CanonicalRecords,
+// and returns the sorted records only in current as added and those only in old as removed
+func Diff(old, current []string) (added, removed []string) {
+	oldSet := make(map[string]bool, len(old))
+	for _, record := range old {
+		oldSet[record] = true
+	}
+	currentSet := make(map[string]bool, len(current))
+	for _, record := range current {
+		currentSet[record] = true
+		if !oldSet[record] {
+			added = append(added, record)
+		}
+	}
+	for _, record := range old {
+		if !currentSet[record] {
+			removed = append(removed, record)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
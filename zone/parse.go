@@ -1,39 +1,141 @@
 package zone
 
 import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/miekg/dns"
+	"github.com/ulikunitz/xz"
 )
 
 // ParseZoneFile parses the provided zonefile into a Zone
-func ParseZoneFile(filename string) (Zone, error) {
+// zonefiles compressed with gzip, bzip2 or xz are decompressed based on their extension or contents
+// relative names are completed with origin, if origin is empty it is inferred from a filename ending in .zone
+// $INCLUDE directives are followed relative to the zonefile's directory
+func ParseZoneFile(filename, origin string) (Zone, error) {
 	var z Zone
+	err := z.AddZoneFile(filename, origin)
+	return z, err
+}
+
+// AddZoneFile adds the records in the provided zonefile to z, see ParseZoneFile
+// it allows Retain to be set before the records are added
+func (z *Zone) AddZoneFile(filename, origin string) error {
+	return readZoneFile(filename, origin, z.AddRecord)
+}
+
+// ReadRecords returns every record in the provided zonefile, see ParseZoneFile
+func ReadRecords(filename, origin string) ([]dns.RR, error) {
+	var rrs []dns.RR
+	err := readZoneFile(filename, origin, func(rr dns.RR) {
+		rrs = append(rrs, rr)
+	})
+	return rrs, err
+}
+
+// readZoneFile calls add with every record in the zonefile
+func readZoneFile(filename, origin string, add func(dns.RR)) error {
 	var fileReader io.Reader
 	file, err := os.Open(filename)
-	fileReader = file
 	if err != nil {
-		return z, err
+		return err
 	}
 	defer file.Close()
-	if strings.HasSuffix(filename, ".gz") {
-		gz, err := gzip.NewReader(file)
-		if err != nil {
-			return z, err
-		}
-		fileReader = gz
-		defer gz.Close()
+	fileReader, err = decompress(filename, file)
+	if err != nil {
+		return err
 	}
-	zp := dns.NewZoneParser(fileReader, "", "")
+	if len(origin) == 0 {
+		origin = OriginFromFilename(filename)
+	}
+	zp := dns.NewZoneParser(fileReader, origin, filename)
+	zp.SetIncludeAllowed(true)
 	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
-		z.AddRecord(rr)
+		add(rr)
+	}
+
+	return zp.Err()
+}
+
+// ReadCommentKeys returns the "; key: value" metadata comments in a zonefile such as those written by allxfr
+// when a key is repeated the last value is returned
+func ReadCommentKeys(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
 	}
+	defer file.Close()
+	r, err := decompress(filename, file)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, dns.MaxMsgSize)
+	for scanner.Scan() {
+		line, ok := strings.CutPrefix(scanner.Text(), "; ")
+		if !ok {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ": ")
+		if ok && !strings.ContainsAny(key, " \t") {
+			keys[key] = value
+		}
+	}
+	return keys, scanner.Err()
+}
 
-	if err := zp.Err(); err != nil {
-		return z, err
+// the magic bytes their contents start with
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// decompress returns a reader of the decompressed contents of file
+// the compression is chosen by the extension of filename, or by the first bytes of file if it has none of them
+func decompress(filename string, file io.Reader) (io.Reader, error) {
+	switch filepath.Ext(filename) {
+	case ".gz":
+		return gzip.NewReader(file)
+	case ".bz2":
+		return bzip2.NewReader(file), nil
+	case ".xz":
+		return xz.NewReader(file)
+	}
+	r := bufio.NewReader(file)
+	// a short file is returned as is and left to the zone parser
+	magic, _ := r.Peek(len(xzMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(r)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return bzip2.NewReader(r), nil
+	case bytes.HasPrefix(magic, xzMagic):
+		return xz.NewReader(r)
+	}
+	return r, nil
+}
+
+// OriginFromFilename returns the zone origin for files named like example.com.zone or example.com.zone.gz
+// an empty string is returned if the origin can not be inferred
+func OriginFromFilename(filename string) string {
+	name := filepath.Base(filename)
+	for _, ext := range []string{".gz", ".bz2", ".xz"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	if !strings.HasSuffix(name, ".zone") {
+		return ""
+	}
+	name = strings.TrimSuffix(name, ".zone")
+	if name == "root" {
+		return "."
 	}
-	return z, nil
+	return dns.Fqdn(name)
 }
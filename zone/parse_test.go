@@ -0,0 +1,67 @@
+package zone
+
+import (
+	"net"
+	"slices"
+	"testing"
+)
+
+func TestParseZoneFileRelativeNames(t *testing.T) {
+	tests := []struct {
+		name   string
+		origin string
+		want   string
+	}{
+		{name: "inferred from filename", origin: "", want: "example.com."},
+		{name: "explicit origin", origin: "example.org.", want: "example.org."},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			z, err := ParseZoneFile("testdata/example.com.zone", test.origin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantNS := map[string][]string{
+				test.want:          {"ns1." + test.want, "ns2.example.net."},
+				"sub." + test.want: {"ns1.sub." + test.want},
+			}
+			if len(z.NS) != len(wantNS) {
+				t.Errorf("got NS %v, want %v", z.NS, wantNS)
+			}
+			for domain, nameservers := range wantNS {
+				if !slices.Equal(z.NS[domain], nameservers) {
+					t.Errorf("got nameservers %v for %s, want %v", z.NS[domain], domain, nameservers)
+				}
+			}
+			wantIP := map[string][]net.IP{
+				"ns1." + test.want:     {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+				"www." + test.want:     {net.ParseIP("192.0.2.80")},
+				"ns1.sub." + test.want: {net.ParseIP("192.0.2.2")},
+			}
+			if len(z.IP) != len(wantIP) {
+				t.Errorf("got IPs %v, want %v", z.IP, wantIP)
+			}
+			for host, ips := range wantIP {
+				if !slices.EqualFunc(z.IP[host], ips, net.IP.Equal) {
+					t.Errorf("got addresses %v for %s, want %v", z.IP[host], host, ips)
+				}
+			}
+		})
+	}
+}
+
+func TestOriginFromFilename(t *testing.T) {
+	tests := map[string]string{
+		"example.com.zone":          "example.com.",
+		"dir/example.com.zone.gz":   "example.com.",
+		"example.com.zone.bz2":      "example.com.",
+		"root.zone.xz":              ".",
+		"example.com._ns1_192_zone": "",
+		"example.com":               "",
+	}
+	for filename, want := range tests {
+		if got := OriginFromFilename(filename); got != want {
+			t.Errorf("OriginFromFilename(%q) = %q, want %q", filename, got, want)
+		}
+	}
+}
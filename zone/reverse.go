@@ -0,0 +1,57 @@
+package zone
+
+import (
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ReverseZones returns the in-addr.arpa or ip6.arpa zones covering cidr
+// prefixes not on an octet (IPv4) or nibble (IPv6) boundary are split into the zones of the next longer boundary
+func ReverseZones(cidr string) ([]string, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipNet.Mask.Size()
+	step := 4
+	if bits == 8*net.IPv4len {
+		step = 8
+	}
+	boundary := ((ones + step - 1) / step) * step
+
+	base := new(big.Int).SetBytes(ipNet.IP)
+	count := 1 << (boundary - ones)
+	out := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		n := new(big.Int).Lsh(big.NewInt(int64(i)), uint(bits-boundary))
+		n.Add(n, base)
+		ip := make(net.IP, bits/8)
+		n.FillBytes(ip)
+		out = append(out, reverseName(ip, boundary))
+	}
+	return out, nil
+}
+
+// reverseName returns the reverse zone name for the first prefix bits of ip
+// prefix must be a multiple of 8 for IPv4 or 4 for IPv6
+func reverseName(ip net.IP, prefix int) string {
+	labels := make([]string, 0, 35)
+	if len(ip) == net.IPv4len {
+		for i := prefix/8 - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(ip[i])))
+		}
+		labels = append(labels, "in-addr", "arpa", "")
+	} else {
+		for i := prefix/4 - 1; i >= 0; i-- {
+			b := ip[i/2]
+			if i%2 == 0 {
+				b >>= 4
+			}
+			labels = append(labels, strconv.FormatUint(uint64(b&0xf), 16))
+		}
+		labels = append(labels, "ip6", "arpa", "")
+	}
+	return strings.Join(labels, ".")
+}
@@ -1,18 +1,21 @@
 package zone
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
-// GetRootServers returns the DNS root servers
-func GetRootServers(nameserver string) ([]string, error) {
+// GetRootServers returns the DNS root servers using client to query nameserver
+func GetRootServers(client *dns.Client, nameserver string) ([]string, error) {
 	out := make([]string, 0, 4)
 	// get root servers
 	m := new(dns.Msg)
 	m.SetQuestion(".", dns.TypeNS)
-	in, err := dns.Exchange(m, nameserver)
+	in, _, err := client.Exchange(m, nameserver)
 	if err != nil {
 		return out, err
 	}
@@ -28,23 +31,116 @@ func GetRootServers(nameserver string) ([]string, error) {
 	return out, nil
 }
 
+// ParseRootHints returns the root server IPs listed in a root hints file in BIND named.root format
+func ParseRootHints(filename string) ([]string, error) {
+	hints, err := ParseZoneFile(filename, ".")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0, 26)
+	for _, ns := range hints.NS["."] {
+		for _, ip := range hints.IP[ns] {
+			out = append(out, ip.String())
+		}
+	}
+	if len(out) == 0 {
+		return out, fmt.Errorf("no root server addresses found in %s", filename)
+	}
+	return out, nil
+}
+
+// limits used for the root zone transfer when RootOptions are not set
+// they are far larger than the real root zone but stop a malicious server from using all of the memory
+const (
+	DefaultRootMaxRecords = 1000000
+	DefaultRootMaxSize    = 128 << 20
+	DefaultRootMaxLabels  = 16
+)
+
+// RootOptions limits the root zone transfer, zero values use the defaults
+type RootOptions struct {
+	// Timeout is the timeout for dialing, reading and writing
+	Timeout time.Duration
+	// MaxRecords and MaxSize abort the transfer after more records or bytes of wire format records than this
+	MaxRecords int64
+	MaxSize    int64
+	// MaxLabels aborts the transfer if any record has an owner name with more labels than this
+	MaxLabels int
+	// SourceIP is the local address to transfer from if set
+	SourceIP net.IP
+	// OnRecord is called with every record of the transfer if set, including the records of a transfer that later fails
+	OnRecord func(rr dns.RR)
+}
+
 // RootAXFR returns a Zone containing the ROOT zone
-func RootAXFR(ns string) (Zone, error) {
+// ns may be a hostname or an IP address, the transfer is stopped when ctx is done
+func RootAXFR(ctx context.Context, ns string, opts RootOptions) (Zone, error) {
+	if opts.MaxRecords <= 0 {
+		opts.MaxRecords = DefaultRootMaxRecords
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultRootMaxSize
+	}
+	if opts.MaxLabels <= 0 {
+		opts.MaxLabels = DefaultRootMaxLabels
+	}
 	m := new(dns.Msg)
 	m.SetQuestion(".", dns.TypeAXFR)
 	t := new(dns.Transfer)
+	if opts.Timeout > 0 {
+		t.DialTimeout = opts.Timeout
+		t.ReadTimeout = opts.Timeout
+		t.WriteTimeout = opts.Timeout
+	}
 
 	var root Zone
-	env, err := t.In(m, fmt.Sprintf("%s:53", ns))
+	addr := net.JoinHostPort(ns, "53")
+	dialer := net.Dialer{Timeout: opts.Timeout}
+	if opts.SourceIP != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: opts.SourceIP}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return root, fmt.Errorf("transfer error from %v: %w", ns, err)
+	}
+	// closing the connection when the context is done interrupts any blocked read or write
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	t.Conn = &dns.Conn{Conn: conn}
+	env, err := t.In(m, addr)
 	if err != nil {
+		conn.Close()
 		return root, fmt.Errorf("transfer error from %v: %w", ns, err)
 	}
+	defer func() {
+		// stop the transfer if returning early and let it finish sending its result
+		conn.Close()
+		go func() {
+			for range env {
+			}
+		}()
+	}()
+	var records, size int64
 	for e := range env {
 		if e.Error != nil {
+			if ctx.Err() != nil {
+				return root, fmt.Errorf("transfer from %v stopped: %w", ns, ctx.Err())
+			}
 			return root, fmt.Errorf("transfer envelope error from %v: %w", ns, e.Error)
 		}
 		for _, r := range e.RR {
+			records++
+			size += int64(dns.Len(r))
+			if records > opts.MaxRecords || size > opts.MaxSize {
+				return root, fmt.Errorf("transfer from %v exceeded limit after %d records and %d bytes", ns, records, size)
+			}
+			if labels := dns.CountLabel(r.Header().Name); labels > opts.MaxLabels {
+				return root, fmt.Errorf("transfer from %v has record with %d labels: %s", ns, labels, r.Header().Name)
+			}
 			root.AddRecord(r)
+			if opts.OnRecord != nil {
+				opts.OnRecord(r)
+			}
 		}
 	}
 	return root, nil
@@ -2,7 +2,9 @@ package zone
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
+	"sort"
 	"strings"
 
 	"github.com/miekg/dns"
@@ -16,10 +18,29 @@ type Zone struct {
 	IP map[string][]net.IP
 	// number of records added to the zone
 	Records int64
+	// names explicitly requested that are returned by Names even when they would normally be skipped
+	targets map[string]bool
+	// number of records passed to AddRecord by type
+	counts map[uint16]int
+	// types of records kept by AddRecord, set with Retain
+	retain   map[uint16]bool
+	retained map[uint16][]dns.RR
 }
 
 // AddRecord adds NS, A, AAAA records to the zone
+// every record is counted by type and records of the types passed to Retain are kept
 func (z *Zone) AddRecord(r dns.RR) {
+	rrtype := r.Header().Rrtype
+	if z.counts == nil {
+		z.counts = make(map[uint16]int)
+	}
+	z.counts[rrtype]++
+	if z.retain[rrtype] {
+		if z.retained == nil {
+			z.retained = make(map[uint16][]dns.RR)
+		}
+		z.retained[rrtype] = append(z.retained[rrtype], r)
+	}
 	switch t := r.(type) {
 	case *dns.A:
 		z.AddIP(t.Hdr.Name, t.A)
@@ -30,23 +51,92 @@ func (z *Zone) AddRecord(r dns.RR) {
 	}
 }
 
-// GetNameChan returns a channel of domains in the zone
-func (z *Zone) GetNameChan() chan string {
-	out := make(chan string)
-	go func() {
-		for domain := range z.NS {
-			// skip root & arpa
-			if domain == "." {
-				continue
+// RecordCounts returns the number of records of each type passed to AddRecord
+func (z *Zone) RecordCounts() map[uint16]int {
+	out := make(map[uint16]int, len(z.counts))
+	for rrtype, count := range z.counts {
+		out[rrtype] = count
+	}
+	return out
+}
+
+// Retain keeps the records of the given types passed to AddRecord after it is called so they can be read with Retained
+// nothing is kept by default to keep large zones small in memory
+func (z *Zone) Retain(types ...uint16) {
+	if z.retain == nil {
+		z.retain = make(map[uint16]bool)
+	}
+	for _, rrtype := range types {
+		z.retain[rrtype] = true
+	}
+}
+
+// Retained returns the records of rrtype kept because of Retain
+func (z *Zone) Retained(rrtype uint16) []dns.RR {
+	return z.retained[rrtype]
+}
+
+// ShuffledNames returns the domains in the zone in a random order that is reproducible from seed
+// when interleave is set the order is rearranged so that consecutive domains do not share a nameserver where possible
+func (z *Zone) ShuffledNames(seed int64, interleave bool) []string {
+	names := z.Names()
+	// sort first so the result depends only on the seed and not map iteration order
+	sort.Strings(names)
+	r := rand.New(rand.NewSource(seed))
+	r.Shuffle(len(names), func(i, j int) { names[i], names[j] = names[j], names[i] })
+	if interleave {
+		names = z.interleave(names)
+	}
+	return names
+}
+
+// Names returns the domains in the zone that should be transferred, root and arpa are skipped
+func (z *Zone) Names() []string {
+	out := make([]string, 0, len(z.NS))
+	for domain := range z.NS {
+		// skip root & arpa
+		if domain == "." {
+			continue
+		}
+		parts := strings.Split(domain, ".")
+		if parts[len(parts)-2] == "arpa" && !z.targets[domain] {
+			continue
+		}
+		out = append(out, domain)
+	}
+	return out
+}
+
+// interleave groups names by the lexically smallest of their nameservers, so the grouping does not depend on the order the
+// nameservers were added in, and then takes one name from each group in turn
+// the order of names within each group and of the groups themselves is kept
+func (z *Zone) interleave(names []string) []string {
+	groups := make(map[string][]string)
+	keys := make([]string, 0)
+	for _, domain := range names {
+		var key string
+		if len(z.NS[domain]) > 0 {
+			key = z.NS[domain][0]
+			for _, nameserver := range z.NS[domain][1:] {
+				if nameserver < key {
+					key = nameserver
+				}
 			}
-			parts := strings.Split(domain, ".")
-			if parts[len(parts)-2] == "arpa" {
-				continue
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], domain)
+	}
+	out := make([]string, 0, len(names))
+	for len(out) < len(names) {
+		for _, key := range keys {
+			if len(groups[key]) > 0 {
+				out = append(out, groups[key][0])
+				groups[key] = groups[key][1:]
 			}
-			out <- domain
 		}
-		close(out)
-	}()
+	}
 	return out
 }
 
@@ -72,6 +162,16 @@ func (z *Zone) AddNS(domain, nameserver string) {
 	}
 }
 
+// AddTarget adds a domain that should be transferred even if it would normally be skipped, such as zones under arpa
+func (z *Zone) AddTarget(domain string) {
+	domain = strings.ToLower(domain)
+	if z.targets == nil {
+		z.targets = make(map[string]bool)
+	}
+	z.targets[domain] = true
+	z.AddNS(domain, "")
+}
+
 // AddIP adds a nameserver IP pair to the zone
 func (z *Zone) AddIP(nameserver string, ip net.IP) {
 	nameserver = strings.ToLower(nameserver)